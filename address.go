@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Addresses the user gives are collected across turns and saved to user_addresses
+// once complete. A partial address waits in the conversation's metadata
+// ("pending_address") while the bot asks for the one component it still needs.
+
+type address struct {
+	Line1      string `json:"line1,omitempty"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city,omitempty"`
+	State      string `json:"state,omitempty"`
+	PostalCode string `json:"postal_code,omitempty"`
+	Country    string `json:"country,omitempty"`
+}
+
+// postalRule is a country's postal code format. format is nil for countries without
+// postal codes; space is where "A1A1A1" gets its space ("A1A 1A1"), counted from the end.
+type postalRule struct {
+	format *regexp.Regexp
+	space  int
+}
+
+var postalRules = map[string]postalRule{
+	"US": {format: regexp.MustCompile(`^\d{5}(-\d{4})?$`)},
+	"CA": {format: regexp.MustCompile(`^[ABCEGHJ-NPRSTVXY]\d[ABCEGHJ-NPRSTV-Z] ?\d[ABCEGHJ-NPRSTV-Z]\d$`), space: 3},
+	"GB": {format: regexp.MustCompile(`^([A-Z]{1,2}\d[A-Z\d]?|GIR) ?\d[A-Z]{2}$`), space: 3},
+	"IE": {format: regexp.MustCompile(`^[A-Z]\d[\dW] ?[0-9A-Z]{4}$`), space: 4},
+	"NL": {format: regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`), space: 2},
+	"SE": {format: regexp.MustCompile(`^\d{3} ?\d{2}$`), space: 2},
+	"PL": {format: regexp.MustCompile(`^\d{2}-\d{3}$`)},
+	"PT": {format: regexp.MustCompile(`^\d{4}-\d{3}$`)},
+	"JP": {format: regexp.MustCompile(`^\d{3}-?\d{4}$`)},
+	"BR": {format: regexp.MustCompile(`^\d{5}-?\d{3}$`)},
+	"FR": {format: regexp.MustCompile(`^\d{5}$`)},
+	"DE": {format: regexp.MustCompile(`^\d{5}$`)},
+	"ES": {format: regexp.MustCompile(`^\d{5}$`)},
+	"IT": {format: regexp.MustCompile(`^\d{5}$`)},
+	"FI": {format: regexp.MustCompile(`^\d{5}$`)},
+	"MX": {format: regexp.MustCompile(`^\d{5}$`)},
+	"BE": {format: regexp.MustCompile(`^\d{4}$`)},
+	"CH": {format: regexp.MustCompile(`^\d{4}$`)},
+	"AT": {format: regexp.MustCompile(`^\d{4}$`)},
+	"DK": {format: regexp.MustCompile(`^\d{4}$`)},
+	"NO": {format: regexp.MustCompile(`^\d{4}$`)},
+	"AU": {format: regexp.MustCompile(`^\d{4}$`)},
+	"NZ": {format: regexp.MustCompile(`^\d{4}$`)},
+	"ZA": {format: regexp.MustCompile(`^\d{4}$`)},
+	"IN": {format: regexp.MustCompile(`^\d{6}$`)},
+	"SG": {format: regexp.MustCompile(`^\d{6}$`)},
+	"AE": {},
+	"HK": {},
+}
+
+// stateRequired lists the countries whose addresses are incomplete without a state.
+var stateRequired = map[string]bool{"US": true, "CA": true, "AU": true, "BR": true, "MX": true, "IN": true}
+
+var addressComponentNames = map[string]string{"line1": "street address", "city": "city", "state": "state or province", "postal_code": "postal code", "country": "country"}
+
+func addressFromMap(m map[string]any) address {
+	s := func(k string) string { return strings.TrimSpace(asString(m[k])) }
+	return address{Line1: s("line1"), Line2: s("line2"), City: s("city"), State: s("state"), PostalCode: s("postal_code"), Country: s("country")}
+}
+
+func (a address) empty() bool { return a == address{} }
+
+// overlay fills a's components with b's non-empty ones.
+func (a address) overlay(b address) address {
+	pick := func(x, y string) string { return ternary(y != "", y, x) }
+	return address{pick(a.Line1, b.Line1), pick(a.Line2, b.Line2), pick(a.City, b.City), pick(a.State, b.State), pick(a.PostalCode, b.PostalCode), pick(a.Country, b.Country)}
+}
+
+// normalizePostal upper-cases the code and puts the space where the country writes it.
+// ok is false when the code does not match the country's format.
+func normalizePostal(country, code string) (string, bool) {
+	r, known := postalRules[country]
+	if !known || r.format == nil {
+		return code, true
+	}
+	code = strings.ToUpper(strings.Join(strings.Fields(code), ""))
+	if !r.format.MatchString(code) {
+		return code, false
+	}
+	if r.space > 0 && len(code) > r.space {
+		code = code[:len(code)-r.space] + " " + code[len(code)-r.space:]
+	}
+	return code, r.format.MatchString(code)
+}
+
+// missing returns the required components a lacks, most useful first.
+func (a address) missing() []string {
+	out := []string{}
+	if a.Line1 == "" {
+		out = append(out, "line1")
+	}
+	if a.City == "" {
+		out = append(out, "city")
+	}
+	if a.State == "" && stateRequired[a.Country] {
+		out = append(out, "state")
+	}
+	if r, known := postalRules[a.Country]; a.PostalCode == "" && (!known || r.format != nil) {
+		out = append(out, "postal_code")
+	}
+	if a.Country == "" {
+		out = append(out, "country")
+	}
+	return out
+}
+
+// addressResult is what a turn did with the address the user is giving.
+type addressResult struct {
+	Status  string  `json:"status"` // saved, incomplete or invalid_postal_code
+	Address address `json:"address"`
+	Missing string  `json:"missing,omitempty"`
+}
+
+// resolveAddress combines the address components extracted this turn with the
+// conversation's pending address. A bare reply to the bot's question ("62704",
+// "Springfield") is taken as the component that was asked for. ok is false when the
+// turn has nothing to do with an address.
+func resolveAddress(extracted, convMeta map[string]any, message, defaultCountry string) (res addressResult, ok bool) {
+	pendingMap := mapOf(convMeta["pending_address"])
+	pending := addressFromMap(pendingMap)
+	got := addressFromMap(mapOf(extracted["address_components"]))
+	if asked := asString(pendingMap["asked"]); got.empty() && asked != "" {
+		got = answerFor(asked, message, pending.Country)
+	}
+	if got.empty() || (pending.empty() && got.Line1 == "" && got.City == "") {
+		// A postal code or country on its own (as the rule pass finds in passing) does
+		// not start an address.
+		return res, false
+	}
+	a := pending.overlay(got)
+	a.Country = countryCode(a.Country)
+	if a.Country == "" && a.Line1 != "" && a.City != "" {
+		a.Country = countryCode(defaultCountry)
+	}
+	if a.PostalCode != "" && a.Country != "" {
+		code, valid := normalizePostal(a.Country, a.PostalCode)
+		if !valid {
+			a.PostalCode = ""
+			return addressResult{Status: "invalid_postal_code", Address: a, Missing: "postal_code"}, true
+		}
+		a.PostalCode = code
+	}
+	if m := a.missing(); len(m) > 0 {
+		return addressResult{Status: "incomplete", Address: a, Missing: m[0]}, true
+	}
+	return addressResult{Status: "saved", Address: a}, true
+}
+
+var placeName = regexp.MustCompile(`^\p{L}[\p{L}.'’ \-]*$`)
+
+// nonAnswerWords are words a reply that is not a place name ("I don't know", "why
+// do you need it") is made of.
+var nonAnswerWords = map[string]bool{
+	"i": true, "i'm": true, "im": true, "my": true, "me": true, "you": true, "your": true, "it": true, "it's": true, "is": true,
+	"no": true, "yes": true, "not": true, "don't": true, "dont": true, "know": true, "sure": true, "why": true, "what": true,
+	"idk": true, "later": true, "skip": true, "need": true, "thanks": true, "ok": true, "okay": true, "please": true,
+}
+
+// looksLikePlace is the rule check for a bare city or state reply: letters only, at
+// most four words, none of them a non-answer word.
+func looksLikePlace(msg string) bool {
+	words := strings.Fields(strings.ToLower(msg))
+	if len(words) > 4 || !placeName.MatchString(msg) {
+		return false
+	}
+	for _, w := range words {
+		if nonAnswerWords[w] {
+			return false
+		}
+	}
+	return true
+}
+
+// answerFor reads a short reply as the single component the bot asked for. Replies
+// the extractor found no address in are only taken as a city or state when they
+// pass looksLikePlace.
+func answerFor(asked, message, country string) address {
+	msg := strings.TrimSpace(strings.TrimRight(message, ".!"))
+	if msg == "" || strings.Contains(msg, "?") || len(strings.Fields(msg)) > 6 {
+		return address{}
+	}
+	switch asked {
+	case "postal_code":
+		if strings.ContainsAny(msg, "0123456789") && len(msg) <= 12 {
+			return address{PostalCode: msg}
+		}
+	case "country":
+		if c := countryCode(msg); c != "" {
+			return address{Country: c}
+		}
+	case "line1":
+		if strings.ContainsAny(msg, "0123456789") {
+			return address{Line1: msg}
+		}
+	case "city":
+		if looksLikePlace(msg) {
+			return address{City: msg}
+		}
+	case "state":
+		if looksLikePlace(msg) {
+			return address{State: msg}
+		}
+	}
+	return address{}
+}
+
+// pendingAddress is the metadata value that keeps a partial address between turns.
+func (r addressResult) pendingAddress() any {
+	if r.Status == "saved" {
+		return nil
+	}
+	m := map[string]any{"asked": r.Missing}
+	for k, v := range map[string]string{"line1": r.Address.Line1, "line2": r.Address.Line2, "city": r.Address.City, "state": r.Address.State, "postal_code": r.Address.PostalCode, "country": r.Address.Country} {
+		if v != "" {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// note asks the chat model for the one missing piece.
+func (r addressResult) note() string {
+	switch r.Status {
+	case "incomplete":
+		return "The user is giving an address but it is missing the " + addressComponentNames[r.Missing] + ". Ask only for the " + addressComponentNames[r.Missing] + "."
+	case "invalid_postal_code":
+		return "The postal code the user gave does not match the format used in " + r.Address.Country + ". Ask them to check the postal code."
+	}
+	return ""
+}
+
+func (a address) fingerprint() string {
+	norm := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+				return r
+			}
+			return -1
+		}, strings.ToLower(s))
+	}
+	return strings.Join([]string{norm(a.Line1), norm(a.Line2), norm(a.PostalCode), a.Country}, "|")
+}
+
+// saveAddress upserts a into the user's address book. The most recently used address
+// is the user's default.
+func saveAddress(ctx context.Context, client *http.Client, userID string, a address, raw string) error {
+	now := isoNow()
+	row := map[string]any{
+		"user_id": userID, "fingerprint": a.fingerprint(), "line1": a.Line1, "line2": nilIfEmpty(a.Line2), "city": a.City, "state": nilIfEmpty(a.State),
+		"postal_code": nilIfEmpty(a.PostalCode), "country": a.Country, "raw": nilIfEmpty(raw), "source": "chat", "last_used_at": now, "updated_at": now,
+	}
+	res, err := sbPost(ctx, client, "user_addresses", row, map[string]string{"on_conflict": "tenant_id,user_id,fingerprint"}, "return=minimal,resolution=merge-duplicates")
+	return sbWriteErr("user_addresses", res, err)
+}
+
+func nilIfEmpty(s string) any { return ternary[any](s != "", s, nil) }
+
+// loadAddresses returns the user's saved addresses, the default first.
+func loadAddresses(ctx context.Context, client *http.Client, userID string) ([]address, error) {
+	res, err := sbGet(ctx, client, "user_addresses", map[string]string{"select": "line1,line2,city,state,postal_code,country", "user_id": "eq." + userID, "order": "last_used_at.desc", "limit": "20"})
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 400 {
+		return nil, sbWriteErr("user_addresses", res, nil)
+	}
+	out := []address{}
+	for _, row := range toSliceMap(res) {
+		out = append(out, addressFromMap(row))
+	}
+	return out, nil
+}
+
+// defaultAddress is the address workflows should use for the user, if any.
+func defaultAddress(ctx context.Context, client *http.Client, userID string) (address, bool) {
+	as, err := loadAddresses(ctx, client, userID)
+	if err != nil || len(as) == 0 {
+		return address{}, false
+	}
+	return as[0], true
+}
+
+// addressWorkflows are the workflows that ship to the user: order status (WF-04)
+// and returns (WF-05).
+var addressWorkflows = map[string]bool{"WF-04": true, "WF-05": true}
+
+// attachWorkflowAddress adds the user's address to extracted's workflow, shaped for
+// the tenant's commerce or helpdesk integration: the address completed this turn,
+// else the user's default (def, loaded alongside the conversation). It returns the
+// address attached.
+func attachWorkflowAddress(ctx context.Context, extracted map[string]any, addr addressResult, def address, hasDef bool) (address, bool) {
+	state := mapOf(extracted["workflow"])
+	if !addressWorkflows[asString(state["id"])] {
+		return address{}, false
+	}
+	a, ok := addr.Address, addr.Status == "saved"
+	if !ok {
+		a, ok = def, hasDef
+	}
+	if !ok {
+		return address{}, false
+	}
+	integration := ""
+	for _, name := range []string{"shopify", "zoho_desk"} {
+		if _, enabled := integrationFor(ctx, name); enabled {
+			integration = name
+			break
+		}
+	}
+	state["address"] = a.forIntegration(integration)
+	extracted["workflow"] = state
+	return a, true
+}
+
+// forIntegration shapes a for an integration's API: Shopify's MailingAddress input or
+// a Zoho Desk contact's address fields.
+func (a address) forIntegration(name string) map[string]any {
+	switch name {
+	case "shopify":
+		return map[string]any{"address1": a.Line1, "address2": a.Line2, "city": a.City, "provinceCode": a.State, "zip": a.PostalCode, "countryCode": a.Country}
+	case "zoho_desk":
+		return map[string]any{"street": strings.TrimSpace(a.Line1 + " " + a.Line2), "city": a.City, "state": a.State, "zip": a.PostalCode, "country": a.Country}
+	}
+	return map[string]any{"line1": a.Line1, "line2": a.Line2, "city": a.City, "state": a.State, "postal_code": a.PostalCode, "country": a.Country}
+}
+
+// addressesHandler serves GET /v1/addresses: the caller's saved addresses, shaped for
+// ?integration=shopify|zoho_desk when given.
+func addressesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, 405, map[string]any{"detail": "method not allowed"})
+		return
+	}
+	ctx := r.Context()
+	client := &http.Client{Timeout: 30 * time.Second}
+	user, err := ensureAppUserForAnon(ctx, client, getOrSetAnonID(w, r))
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	as, err := loadAddresses(ctx, client, asString(user["id"]))
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	integration := r.URL.Query().Get("integration")
+	out := []map[string]any{}
+	for _, a := range as {
+		out = append(out, a.forIntegration(integration))
+	}
+	writeJSON(w, 200, map[string]any{"addresses": out})
+}
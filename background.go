@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// Non-critical writes (events, tool_calls) run after the response is sent. They keep
+// the request's ids and trace but not its cancellation.
+var (
+	backgroundWG sync.WaitGroup
+
+	backgroundMu      sync.Mutex
+	backgroundNext    int
+	backgroundRunning = map[int]chan struct{}{}
+)
+
+func goBackground(ctx context.Context, name string, fn func(ctx context.Context)) {
+	ctx = context.WithoutCancel(ctx)
+	backgroundWG.Add(1)
+	backgroundMu.Lock()
+	id, done := backgroundNext, make(chan struct{})
+	backgroundNext++
+	backgroundRunning[id] = done
+	backgroundMu.Unlock()
+	go func() {
+		defer backgroundWG.Done()
+		defer func() {
+			backgroundMu.Lock()
+			delete(backgroundRunning, id)
+			backgroundMu.Unlock()
+			close(done)
+		}()
+		defer func() {
+			if rec := recover(); rec != nil {
+				logFrom(ctx).Error("background task panicked", "task", name, "panic", rec)
+			}
+		}()
+		ctx, span := startSpan(ctx, name)
+		defer span.End()
+		fn(ctx)
+	}()
+}
+
+// waitBackground blocks until every task started with goBackground has finished.
+func waitBackground() { backgroundWG.Wait() }
+
+// waitBackgroundStarted blocks until the tasks running now have finished. Unlike
+// waitBackground it is safe while requests keep starting new ones.
+func waitBackgroundStarted() {
+	backgroundMu.Lock()
+	running := make([]chan struct{}, 0, len(backgroundRunning))
+	for _, done := range backgroundRunning {
+		running = append(running, done)
+	}
+	backgroundMu.Unlock()
+	for _, done := range running {
+		<-done
+	}
+}
+
+// sequentialTurns makes runStage and goStage run their work inline, one round trip
+// after another. BenchmarkChatTurn sets it for its baseline.
+var sequentialTurns bool
+
+// runStage runs fn alongside the rest of the chat turn and returns a channel that is
+// closed when fn returns.
+func runStage(fn func()) <-chan struct{} {
+	done := make(chan struct{})
+	if sequentialTurns {
+		fn()
+		close(done)
+		return done
+	}
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	return done
+}
+
+// goStage runs fn alongside the rest of the chat turn as part of wg.
+func goStage(wg *sync.WaitGroup, fn func()) {
+	if sequentialTurns {
+		fn()
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fn()
+	}()
+}
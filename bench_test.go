@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	benchSupabaseLatency = flag.Duration("supabase-latency", 25*time.Millisecond, "latency of each fake Supabase call in BenchmarkChatTurn")
+	benchOpenAILatency   = flag.Duration("openai-latency", 300*time.Millisecond, "latency of each fake OpenAI call in BenchmarkChatTurn")
+)
+
+// BenchmarkChatTurn drives chatHandler against the fake backend with fixed per-call
+// latency and reports turn latency percentiles and upstream calls per turn, once with
+// the turn's round trips overlapped as in production and once one after another as a
+// baseline:
+//
+//	go test -run '^$' -bench ChatTurn -benchtime 30x -supabase-latency 25ms -openai-latency 300ms
+func BenchmarkChatTurn(b *testing.B) {
+	for _, mode := range []string{"concurrent", "sequential"} {
+		b.Run(mode, func(b *testing.B) {
+			sequentialTurns = mode == "sequential"
+			defer func() { sequentialTurns = false }()
+			benchChatTurns(b)
+		})
+	}
+}
+
+func benchChatTurns(b *testing.B) {
+	fake := newFakeBackend(*benchSupabaseLatency, *benchOpenAILatency)
+	useFakeBackend(b, fake)
+
+	lat := make([]time.Duration, 0, b.N)
+	calls := int64(0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		body := fmt.Sprintf(`{"session_id":"bench-session","message":"bench message %d"}`, i)
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat", strings.NewReader(body))
+		req.AddCookie(&http.Cookie{Name: anonCookie, Value: "bench-anon"})
+		rec := httptest.NewRecorder()
+		before := fake.Calls()
+		t0 := time.Now()
+		chatHandler(rec, req)
+		lat = append(lat, time.Since(t0))
+		waitBackground()
+		calls += fake.Calls() - before
+		if rec.Code != 200 {
+			b.Fatalf("turn %d: status %d: %s", i, rec.Code, rec.Body.String())
+		}
+	}
+	b.StopTimer()
+	sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+	pct := func(p float64) float64 { return float64(lat[int(p*float64(len(lat)-1))].Microseconds()) / 1000 }
+	b.ReportMetric(pct(0.5), "p50-ms")
+	b.ReportMetric(pct(0.95), "p95-ms")
+	b.ReportMetric(float64(calls)/float64(len(lat)), "calls/turn")
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Spend budgets cap model usage per UTC day and month, in tokens and/or USD, at three
+// scopes: the whole process, each tenant, and each anonymous user. Past
+// budget.soft_percent of any limit turns are answered by budget.soft_model; at 100%
+// they get budgetLimitReply without calling a model. Spend is counted in memory and
+// seeded per tenant from llm_usage on first use, so it survives restarts.
+type budgetLimits struct {
+	DailyTokens   int64   `json:"daily_tokens,omitempty"`
+	MonthlyTokens int64   `json:"monthly_tokens,omitempty"`
+	DailyUSD      float64 `json:"daily_usd,omitempty"`
+	MonthlyUSD    float64 `json:"monthly_usd,omitempty"`
+}
+
+func (b budgetLimits) empty() bool { return b == budgetLimits{} }
+
+// parseBudget reads "daily_usd=5,monthly_usd=100,daily_tokens=2000000,monthly_tokens=0";
+// a zero or missing limit is unlimited.
+func parseBudget(v string) (budgetLimits, error) {
+	b := budgetLimits{}
+	for _, part := range splitCSV(v) {
+		k, val, _ := strings.Cut(part, "=")
+		n, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+		if err != nil || n < 0 {
+			return b, fmt.Errorf("%q is not limit=non-negative number", part)
+		}
+		switch strings.TrimSpace(k) {
+		case "daily_tokens":
+			b.DailyTokens = int64(n)
+		case "monthly_tokens":
+			b.MonthlyTokens = int64(n)
+		case "daily_usd":
+			b.DailyUSD = n
+		case "monthly_usd":
+			b.MonthlyUSD = n
+		default:
+			return b, fmt.Errorf("unknown limit %q (daily_tokens, monthly_tokens, daily_usd, monthly_usd)", k)
+		}
+	}
+	return b, nil
+}
+
+const (
+	budgetOK   = "ok"
+	budgetSoft = "soft"
+	budgetHard = "hard"
+
+	budgetLimitModel      = "budget_limit"
+	modelSourceBudgetSoft = "budget_soft_limit"
+)
+
+const budgetLimitReply = "Thanks for your message! We've reached our chat limit for now, so I can't answer right away. Please try again later, or leave your email and our team will get back to you."
+
+var budgetLimitedTurns = newCounterVec("chatbot_budget_limited_turns_total", "Chat turns answered under a soft or hard budget limit.", "level")
+
+// budgetStatus is the most used limit for a turn.
+type budgetStatus struct {
+	Level  string  `json:"level"`
+	Scope  string  `json:"scope,omitempty"`
+	Period string  `json:"period,omitempty"`
+	Metric string  `json:"metric,omitempty"`
+	Used   float64 `json:"used,omitempty"`
+	Limit  float64 `json:"limit,omitempty"`
+}
+
+type spend struct {
+	Tokens int64
+	USD    float64
+}
+
+type budgetCounter struct {
+	day, month     string
+	daily, monthly spend
+}
+
+// budgetSeed is a tenant's load of its month so far from llm_usage; done is closed
+// when it finished. A failed load is removed so the tenant's next turn tries again.
+type budgetSeed struct {
+	done chan struct{}
+}
+
+func (c *budgetCounter) roll(now time.Time) {
+	if d := now.Format("2006-01-02"); c.day != d {
+		c.day, c.daily = d, spend{}
+	}
+	if m := now.Format("2006-01"); c.month != m {
+		c.month, c.monthly = m, spend{}
+	}
+}
+
+var (
+	budgetMu       sync.Mutex
+	budgetCounters = map[string]*budgetCounter{}
+	budgetSeeds    = map[string]*budgetSeed{}
+	budgetSweptDay string
+)
+
+// counterFor returns key's counter rolled to now. budgetMu must be held. Once a day,
+// counters last used in an earlier month are dropped: they would roll to zero anyway,
+// and there is one per visitor.
+func counterFor(key string, now time.Time) *budgetCounter {
+	if d := now.Format("2006-01-02"); budgetSweptDay != d {
+		budgetSweptDay = d
+		month := now.Format("2006-01")
+		for k, c := range budgetCounters {
+			if c.month != month {
+				delete(budgetCounters, k)
+			}
+		}
+	}
+	c := budgetCounters[key]
+	if c == nil {
+		c = &budgetCounter{}
+		budgetCounters[key] = c
+	}
+	c.roll(now)
+	return c
+}
+
+// budgetScopes are the counters and limits that apply to anon's turns in ctx's tenant.
+func budgetScopes(ctx context.Context, anon string) []struct {
+	scope, key string
+	limits     budgetLimits
+} {
+	tenant, c := tenantIDFrom(ctx), configFor(ctx)
+	return []struct {
+		scope, key string
+		limits     budgetLimits
+	}{
+		{"global", "global", getConfig().BudgetGlobal},
+		{"tenant", "tenant:" + tenant, c.BudgetTenant},
+		{"user", "user:" + tenant + ":" + anon, c.BudgetUser},
+	}
+}
+
+func budgetsConfigured(ctx context.Context) bool {
+	for _, s := range budgetScopes(ctx, "") {
+		if !s.limits.empty() {
+			return true
+		}
+	}
+	return false
+}
+
+// budgetLevels evaluates every configured limit for anon, keyed scope/period/metric.
+// budgetMu must be held.
+func budgetLevels(ctx context.Context, anon string, now time.Time) map[string]budgetStatus {
+	soft := float64(configFor(ctx).BudgetSoftPercent) / 100
+	out := map[string]budgetStatus{}
+	for _, s := range budgetScopes(ctx, anon) {
+		if s.limits.empty() {
+			continue
+		}
+		c := counterFor(s.key, now)
+		for _, l := range []struct {
+			period, metric string
+			used, limit    float64
+		}{
+			{"day", "tokens", float64(c.daily.Tokens), float64(s.limits.DailyTokens)},
+			{"month", "tokens", float64(c.monthly.Tokens), float64(s.limits.MonthlyTokens)},
+			{"day", "usd", c.daily.USD, s.limits.DailyUSD},
+			{"month", "usd", c.monthly.USD, s.limits.MonthlyUSD},
+		} {
+			if l.limit <= 0 {
+				continue
+			}
+			level := budgetOK
+			if l.used >= l.limit {
+				level = budgetHard
+			} else if l.used >= soft*l.limit {
+				level = budgetSoft
+			}
+			out[s.scope+"/"+l.period+"/"+l.metric] = budgetStatus{Level: level, Scope: s.scope, Period: l.period, Metric: l.metric, Used: roundUSD(l.used), Limit: l.limit}
+		}
+	}
+	return out
+}
+
+var budgetRank = map[string]int{budgetOK: 0, budgetSoft: 1, budgetHard: 2}
+
+// checkBudget returns the most severe limit state for anon's next turn.
+func checkBudget(ctx context.Context, client *http.Client, anon string) budgetStatus {
+	if !budgetsConfigured(ctx) {
+		return budgetStatus{Level: budgetOK}
+	}
+	seedBudget(ctx, client)
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+	worst := budgetStatus{Level: budgetOK}
+	for _, st := range budgetLevels(ctx, anon, time.Now().UTC()) {
+		if budgetRank[st.Level] > budgetRank[worst.Level] || (st.Level == worst.Level && st.Level != budgetOK && st.Used/st.Limit > worst.Used/worst.Limit) {
+			worst = st
+		}
+	}
+	return worst
+}
+
+// seedBudget loads the tenant's spend for the current month from llm_usage the first
+// time the tenant is checked; turns that arrive meanwhile wait for the load. Only rows
+// written before seeding began are read; later ones are counted by chargeBudget.
+func seedBudget(ctx context.Context, client *http.Client) {
+	tenant := tenantIDFrom(ctx)
+	budgetMu.Lock()
+	if seed := budgetSeeds[tenant]; seed != nil {
+		budgetMu.Unlock()
+		select {
+		case <-seed.done:
+		case <-ctx.Done():
+		}
+		return
+	}
+	seed := &budgetSeed{done: make(chan struct{})}
+	budgetSeeds[tenant] = seed
+	budgetMu.Unlock()
+	defer close(seed.done)
+	now := time.Now().UTC()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	rows, err := loadUsage(ctx, client, monthStart, now, nil)
+	if err != nil {
+		logFrom(ctx).Warn("budget seed failed; counting from zero until the next attempt", "error", err.Error())
+		budgetMu.Lock()
+		delete(budgetSeeds, tenant)
+		budgetMu.Unlock()
+		return
+	}
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+	today := now.Format("2006-01-02")
+	for _, row := range rows {
+		s := spend{Tokens: int64(toInt(row["input_tokens"]) + toInt(row["output_tokens"])), USD: toFloat(row["cost_usd"])}
+		for _, sc := range budgetScopes(ctx, asString(row["anon_id"])) {
+			if sc.limits.empty() {
+				continue
+			}
+			c := counterFor(sc.key, now)
+			c.monthly.Tokens, c.monthly.USD = c.monthly.Tokens+s.Tokens, c.monthly.USD+s.USD
+			if strings.HasPrefix(asString(row["created_at"]), today) {
+				c.daily.Tokens, c.daily.USD = c.daily.Tokens+s.Tokens, c.daily.USD+s.USD
+			}
+		}
+	}
+}
+
+// chargeBudget adds a turn's usage to anon's counters and records a budget.soft_limit
+// or budget.hard_limit event for every limit the turn pushed past a threshold.
+func chargeBudget(ctx context.Context, client *http.Client, userID, conversationID, anon string, usage ...tokenUsage) {
+	if !budgetsConfigured(ctx) {
+		return
+	}
+	s := spend{}
+	for _, u := range usage {
+		s.Tokens += int64(u.InputTokens + u.OutputTokens)
+		s.USD += u.CostUSD
+	}
+	now := time.Now().UTC()
+	budgetMu.Lock()
+	before := budgetLevels(ctx, anon, now)
+	for _, sc := range budgetScopes(ctx, anon) {
+		// Scopes without limits are not counted, so no per-visitor counters pile up
+		// unless user budgets are set.
+		if sc.limits.empty() {
+			continue
+		}
+		c := counterFor(sc.key, now)
+		c.daily.Tokens, c.daily.USD = c.daily.Tokens+s.Tokens, c.daily.USD+s.USD
+		c.monthly.Tokens, c.monthly.USD = c.monthly.Tokens+s.Tokens, c.monthly.USD+s.USD
+	}
+	after := budgetLevels(ctx, anon, now)
+	budgetMu.Unlock()
+	for _, k := range sortedKeys(after) {
+		st := after[k]
+		if budgetRank[st.Level] <= budgetRank[before[k].Level] {
+			continue
+		}
+		logFrom(ctx).Warn("budget threshold crossed", "level", st.Level, "scope", st.Scope, "period", st.Period, "metric", st.Metric, "used", st.Used, "limit", st.Limit)
+		_ = sbInsertEvent(ctx, client, userID, conversationID, "budget."+st.Level+"_limit", "backend", map[string]any{
+			"anon_id": anon, "scope": st.Scope, "period": st.Period, "metric": st.Metric, "used": st.Used, "limit": st.Limit, "soft_percent": configFor(ctx).BudgetSoftPercent,
+		})
+	}
+}
+
+// budgetLimitedTurn answers a turn over a hard limit without calling a model. The
+// exchange is still stored so the conversation shows what the user was told.
+func budgetLimitedTurn(ctx context.Context, w http.ResponseWriter, client *http.Client, anon string, in ChatIn, st budgetStatus) {
+	user, err := ensureAppUserForAnon(ctx, client, anon)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	userID := asString(user["id"])
+	convID := in.ConversationID
+	if convID != "" && asString(loadConversation(ctx, client, convID)["user_id"]) != userID {
+		writeJSON(w, 404, map[string]any{"detail": errConversationNotFound.Error()})
+		return
+	}
+	_ = ensureUserSession(ctx, client, in.SessionID, userID, "web", map[string]any{"anon_id": anon})
+	if convID == "" {
+		if convID, err = ensureOpenConversation(ctx, client, userID, in.SessionID, "web", "en", map[string]any{"anon_id": anon}); err != nil {
+			writeErr(w, err)
+			return
+		}
+	}
+	now := isoNow()
+	_ = sbInsertMessages(ctx, client, []map[string]any{
+		{"conversation_id": convID, "role": "user", "content": in.Message, "created_at": now, "payload": map[string]any{"session_id": in.SessionID, "anon_id": anon, "request_id": requestIDFrom(ctx), "ts": now}},
+		{"conversation_id": convID, "role": "assistant", "content": budgetLimitReply, "created_at": isoTime(time.Now()), "payload": map[string]any{"model_used": budgetLimitModel, "degraded": true, "budget": st, "session_id": in.SessionID, "anon_id": anon, "request_id": requestIDFrom(ctx), "ts": isoNow()}},
+	})
+	writeJSON(w, 200, map[string]any{"anon_id": anon, "session_id": in.SessionID, "conversation_id": convID, "reply": budgetLimitReply, "chat_model": budgetLimitModel, "degraded": true, "budget": st})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSeedBudget checks that turns arriving while a tenant's spend is loaded wait for
+// it, and that a failed load is tried again by the next turn.
+func TestSeedBudget(t *testing.T) {
+	fake := newFakeBackend(20*time.Millisecond, 0)
+	useFakeBackend(t, fake)
+	updateConfig(func(c *RuntimeConfig) {
+		c.BudgetTenant = budgetLimits{MonthlyTokens: 1000}
+		c.UpstreamMaxRetries = 0
+	})
+	reset := func() {
+		budgetMu.Lock()
+		budgetSeeds, budgetCounters = map[string]*budgetSeed{}, map[string]*budgetCounter{}
+		budgetMu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+	now := time.Now().UTC()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	fake.tables["llm_usage"] = []map[string]any{{"id": "l1", "tenant_id": defaultTenantID, "anon_id": "a1", "input_tokens": 300, "output_tokens": 100, "cost_usd": 0.01, "created_at": isoTime(monthStart)}}
+	monthly := func() int64 {
+		budgetMu.Lock()
+		defer budgetMu.Unlock()
+		if c := budgetCounters["tenant:"+defaultTenantID]; c != nil {
+			return c.monthly.Tokens
+		}
+		return 0
+	}
+
+	failLoads := true
+	fake.Fail = func(r *http.Request) int {
+		return ternary(failLoads && strings.HasSuffix(r.URL.Path, "/llm_usage"), 500, 0)
+	}
+	ctx := context.Background()
+	seedBudget(ctx, &http.Client{})
+	if n := monthly(); n != 0 {
+		t.Fatalf("failed load counted %d tokens", n)
+	}
+
+	failLoads = false
+	var wg sync.WaitGroup
+	seen := make([]int64, 5)
+	for i := range seen {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			seedBudget(ctx, &http.Client{})
+			seen[i] = monthly()
+		}()
+	}
+	wg.Wait()
+	for i, n := range seen {
+		if n != 400 {
+			t.Errorf("turn %d saw %d tokens after seeding, want 400", i, n)
+		}
+	}
+	if n := monthly(); n != 400 {
+		t.Errorf("seeded %d tokens, want 400 (loaded once)", n)
+	}
+}
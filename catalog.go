@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// modelCapability describes a chat model. Prices are USD per million tokens.
+type modelCapability struct {
+	Chat          *bool      `json:"chat,omitempty"` // false hides a built-in entry
+	ContextWindow int        `json:"context_window"`
+	JSONSchema    bool       `json:"json_schema"`
+	Tools         bool       `json:"tools"`
+	Price         modelPrice `json:"price_per_mtok"`
+}
+
+type modelPrice struct {
+	Input       float64 `json:"input"`
+	CachedInput float64 `json:"cached_input"`
+	Output      float64 `json:"output"`
+}
+
+// builtinCapabilities lists the chat models the bot knows how to use. A model OpenAI
+// reports is shown only when it, or the base model of a dated snapshot
+// ("gpt-4o-mini-2024-07-18"), is listed here or in openai.capabilities_file.
+var builtinCapabilities = map[string]modelCapability{
+	"gpt-5":        {ContextWindow: 400000, JSONSchema: true, Tools: true, Price: modelPrice{1.25, 0.125, 10}},
+	"gpt-5-mini":   {ContextWindow: 400000, JSONSchema: true, Tools: true, Price: modelPrice{0.25, 0.025, 2}},
+	"gpt-5-nano":   {ContextWindow: 400000, JSONSchema: true, Tools: true, Price: modelPrice{0.05, 0.005, 0.4}},
+	"gpt-4.1":      {ContextWindow: 1047576, JSONSchema: true, Tools: true, Price: modelPrice{2, 0.5, 8}},
+	"gpt-4.1-mini": {ContextWindow: 1047576, JSONSchema: true, Tools: true, Price: modelPrice{0.4, 0.1, 1.6}},
+	"gpt-4.1-nano": {ContextWindow: 1047576, JSONSchema: true, Tools: true, Price: modelPrice{0.1, 0.025, 0.4}},
+	"gpt-4o":       {ContextWindow: 128000, JSONSchema: true, Tools: true, Price: modelPrice{2.5, 1.25, 10}},
+	"gpt-4o-mini":  {ContextWindow: 128000, JSONSchema: true, Tools: true, Price: modelPrice{0.15, 0.075, 0.6}},
+	"o3":           {ContextWindow: 200000, JSONSchema: true, Tools: true, Price: modelPrice{2, 0.5, 8}},
+	"o4-mini":      {ContextWindow: 200000, JSONSchema: true, Tools: true, Price: modelPrice{1.1, 0.275, 4.4}},
+}
+
+var snapshotSuffix = regexp.MustCompile(`-\d{4}-\d{2}-\d{2}$`)
+
+// loadCapabilities merges the JSON object in path ({"model": {...}}) over the built-in
+// table.
+func loadCapabilities(path string) (map[string]modelCapability, error) {
+	out := map[string]modelCapability{}
+	for k, v := range builtinCapabilities {
+		out[k] = v
+	}
+	if path == "" {
+		return out, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var extra map[string]modelCapability
+	if err := json.Unmarshal(b, &extra); err != nil {
+		return nil, err
+	}
+	for k, v := range extra {
+		if v.Chat != nil && !*v.Chat {
+			delete(out, k)
+			continue
+		}
+		out[k] = v
+	}
+	return out, nil
+}
+
+func validateCapabilities(caps map[string]modelCapability) []string {
+	p := []string{}
+	for _, id := range sortedKeys(caps) {
+		c := caps[id]
+		if c.ContextWindow <= 0 {
+			p = append(p, fmt.Sprintf("openai.capabilities_file: %s needs a positive context_window", id))
+		}
+		if c.Price.Input < 0 || c.Price.CachedInput < 0 || c.Price.Output < 0 {
+			p = append(p, fmt.Sprintf("openai.capabilities_file: %s has a negative price", id))
+		}
+	}
+	return p
+}
+
+// capabilityOf looks model up in the configured table, directly or by its base model.
+func capabilityOf(model string) (modelCapability, bool) { return getConfig().capability(model) }
+
+func (rc RuntimeConfig) capability(model string) (modelCapability, bool) {
+	caps := rc.ModelCapabilities
+	if c, ok := caps[model]; ok {
+		return c, true
+	}
+	c, ok := caps[snapshotSuffix.ReplaceAllString(model, "")]
+	return c, ok
+}
+
+type modelList struct {
+	ids        []string
+	at         time.Time
+	refreshing bool
+}
+
+var (
+	modelListsMu sync.Mutex
+	modelLists   = map[string]*modelList{} // by tenant
+)
+
+// availableModels lists the chat-capable model ids the tenant's OpenAI key can use.
+// Lists are cached for openai.models_ttl; a stale list is served while it is refreshed
+// in the background, and only the first request per tenant waits on OpenAI.
+func availableModels(ctx context.Context) ([]string, time.Time, error) {
+	tenant := tenantIDFrom(ctx)
+	modelListsMu.Lock()
+	l := modelLists[tenant]
+	if l != nil && l.ids != nil {
+		ids, at := l.ids, l.at
+		if time.Since(at) >= getConfig().ModelsTTL && !l.refreshing {
+			l.refreshing = true
+			goBackground(ctx, "models.refresh", func(ctx context.Context) { _ = refreshModels(ctx) })
+		}
+		modelListsMu.Unlock()
+		return ids, at, nil
+	}
+	modelListsMu.Unlock()
+	if err := refreshModels(ctx); err != nil {
+		return nil, time.Time{}, err
+	}
+	modelListsMu.Lock()
+	defer modelListsMu.Unlock()
+	return modelLists[tenant].ids, modelLists[tenant].at, nil
+}
+
+func refreshModels(ctx context.Context) error {
+	tenant := tenantIDFrom(ctx)
+	ids, err := fetchModelIDs(ctx)
+	modelListsMu.Lock()
+	defer modelListsMu.Unlock()
+	l := modelLists[tenant]
+	if l == nil {
+		l = &modelList{}
+		modelLists[tenant] = l
+	}
+	l.refreshing = false
+	if err != nil {
+		logFrom(ctx).Warn("model list refresh failed", "error", err.Error())
+		return err
+	}
+	chat := []string{}
+	for _, id := range ids {
+		if _, ok := capabilityOf(id); ok {
+			chat = append(chat, id)
+		}
+	}
+	l.ids, l.at = chat, time.Now()
+	return nil
+}
+
+func fetchModelIDs(ctx context.Context) ([]string, error) {
+	key, err := requireOpenAIKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, getConfig().OpenAIBaseURL+"/v1/models", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	resp, body, err := doReq(req, 25*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("openai models failed: %d %s", resp.StatusCode, truncate(string(body), 300))
+	}
+	var parsed map[string]any
+	_ = json.Unmarshal(body, &parsed)
+	ids := []string{}
+	if arr, ok := parsed["data"].([]any); ok {
+		for _, v := range arr {
+			if m, ok := v.(map[string]any); ok {
+				if id, ok := m["id"].(string); ok {
+					ids = append(ids, id)
+				}
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// startModelRefresher keeps every tenant's cached list warm so no request pays for a
+// refresh once the process is up.
+func startModelRefresher() {
+	go func() {
+		for {
+			time.Sleep(getConfig().ModelsTTL)
+			modelListsMu.Lock()
+			tenants := sortedKeys(modelLists)
+			modelListsMu.Unlock()
+			for _, id := range tenants {
+				_ = refreshModels(withTenant(context.Background(), tenantByID(id)))
+			}
+		}
+	}()
+}
+
+// modelAllowed reports whether model may be chosen by a client. While the model list is
+// unavailable only the models named in configuration are accepted.
+func modelAllowed(ctx context.Context, model string) bool {
+	if ids, _, err := availableModels(ctx); err == nil {
+		return containsString(ids, model)
+	}
+	c := configFor(ctx)
+	if model == c.PreferredModel {
+		return true
+	}
+	for _, chain := range c.ModelFallbacks {
+		if containsString(chain, model) {
+			return true
+		}
+	}
+	return false
+}
+
+func modelsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if _, err := requireOpenAIKey(ctx); err != nil {
+		writeJSON(w, 400, map[string]any{"detail": err.Error()})
+		return
+	}
+	ids, at, err := availableModels(ctx)
+	if err != nil {
+		writeJSON(w, 502, map[string]any{"detail": err.Error()})
+		return
+	}
+	data := []map[string]any{}
+	for _, id := range ids {
+		c, _ := capabilityOf(id)
+		data = append(data, map[string]any{"id": id, "context_window": c.ContextWindow, "json_schema": c.JSONSchema, "tools": c.Tools, "price_per_mtok": c.Price})
+	}
+	def := configFor(ctx).PreferredModel
+	if !containsString(ids, def) && len(ids) > 0 {
+		def = ids[0]
+	}
+	writeJSON(w, 200, map[string]any{"models": ids, "data": data, "default": def, "fetched_at": at.UTC().Format(time.RFC3339)})
+}
@@ -0,0 +1,796 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Configuration is layered, lowest to highest precedence:
+//
+//	defaults → CONFIG_FILE (TOML or YAML) → .env → process environment → admin overrides
+//
+// Every setting has a dotted key used in the config file and admin overrides, and one
+// or more environment variables. Secrets and listener settings are read once at
+// startup; everything else is re-read on SIGHUP.
+type RuntimeConfig struct {
+	SupabaseURL         string                     `json:"supabase_url,omitempty"`
+	SupabaseServiceRole string                     `json:"supabase_service_role,omitempty"`
+	OpenAIAPIKey        string                     `json:"openai_api_key,omitempty"`
+	OpenAIBaseURL       string                     `json:"openai_base_url,omitempty"`
+	PreferredModel      string                     `json:"preferred_model,omitempty"`
+	ExtractorModel      string                     `json:"extractor_model,omitempty"`
+	ModelFallbacks      map[string][]string        `json:"model_fallbacks,omitempty"`
+	ChatModelTimeout    time.Duration              `json:"chat_model_timeout,omitempty"`
+	ModelsTTL           time.Duration              `json:"models_ttl,omitempty"`
+	CapabilitiesFile    string                     `json:"capabilities_file,omitempty"`
+	ModelCapabilities   map[string]modelCapability `json:"-"`
+	BudgetGlobal        budgetLimits               `json:"budget_global"`
+	BudgetTenant        budgetLimits               `json:"budget_tenant"`
+	BudgetUser          budgetLimits               `json:"budget_user"`
+	BudgetSoftPercent   int                        `json:"budget_soft_percent,omitempty"`
+	BudgetSoftModel     string                     `json:"budget_soft_model,omitempty"`
+	PhoneDefaultCountry string                     `json:"phone_default_country,omitempty"`
+	EmailDomainRules    map[string]emailRule       `json:"email_domain_rules,omitempty"`
+	EmailDisposable     []string                   `json:"email_disposable_domains,omitempty"`
+	ConfirmBelow        int                        `json:"extraction_confirm_below"`
+	Moderation          string                     `json:"moderation_classifier,omitempty"`
+	ModerationModel     string                     `json:"moderation_model,omitempty"`
+	ModerationPolicy    map[string]string          `json:"moderation_policy,omitempty"`
+	UIOrigins           []string                   `json:"ui_origins,omitempty"`
+	HTTP                serverConfig               `json:"http"`
+	UpstreamMaxRetries  int                        `json:"upstream_max_retries"`
+	UpstreamRetryBase   time.Duration              `json:"upstream_retry_base,omitempty"`
+	UpstreamRetryMax    time.Duration              `json:"upstream_retry_max,omitempty"`
+	BreakerThreshold    int                        `json:"breaker_threshold,omitempty"`
+	BreakerCooldown     time.Duration              `json:"breaker_cooldown,omitempty"`
+	LogLevel            string                     `json:"log_level,omitempty"`
+	LogFormat           string                     `json:"log_format,omitempty"`
+	TraceExporter       string                     `json:"trace_exporter,omitempty"`
+	TraceEndpoint       string                     `json:"trace_endpoint,omitempty"`
+	ServiceName         string                     `json:"service_name,omitempty"`
+	OutboxPath          string                     `json:"outbox_path,omitempty"`
+	AdminToken          string                     `json:"admin_token,omitempty"`
+	TenantsFile         string                     `json:"tenants_file,omitempty"`
+	Tenants             []Tenant                   `json:"-"`
+}
+
+var (
+	cfgMu sync.RWMutex
+	cfg   = defaultConfig()
+
+	// adminOverrides holds values set through the admin API; they survive reloads.
+	adminOverrides = map[string]string{}
+)
+
+func defaultConfig() RuntimeConfig {
+	return RuntimeConfig{
+		OpenAIBaseURL:       "https://api.openai.com",
+		PreferredModel:      "gpt-5-mini",
+		ExtractorModel:      "gpt-4o-mini",
+		ModelFallbacks:      map[string][]string{"default": {"gpt-4o-mini"}},
+		ChatModelTimeout:    60 * time.Second,
+		ModelsTTL:           10 * time.Minute,
+		ModelCapabilities:   builtinCapabilities,
+		BudgetSoftPercent:   80,
+		BudgetSoftModel:     "gpt-4o-mini",
+		PhoneDefaultCountry: "US",
+		ConfirmBelow:        70,
+		Moderation:          "local",
+		ModerationModel:     "omni-moderation-latest",
+		UIOrigins:           []string{"http://localhost:5173", "http://127.0.0.1:5173", "http://localhost:3000", "http://127.0.0.1:3000", "file://"},
+		HTTP: serverConfig{
+			Addr:              ":8000",
+			ReadTimeout:       15 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			// A turn's model calls get this minus chatTurnReserve, shared across the
+			// fallback chain; see withModelDeadline.
+			WriteTimeout:    180 * time.Second,
+			IdleTimeout:     120 * time.Second,
+			MaxHeaderBytes:  64 << 10,
+			MaxBodyBytes:    1 << 20,
+			ShutdownTimeout: 60 * time.Second,
+			DrainDelay:      5 * time.Second,
+		},
+		UpstreamMaxRetries: 2,
+		UpstreamRetryBase:  250 * time.Millisecond,
+		UpstreamRetryMax:   8 * time.Second,
+		BreakerThreshold:   5,
+		BreakerCooldown:    30 * time.Second,
+		LogLevel:           "info",
+		LogFormat:          "json",
+		TraceExporter:      "none",
+		TraceEndpoint:      "http://localhost:4318",
+		ServiceName:        "go-chatbot",
+		OutboxPath:         "data/outbox.log",
+	}
+}
+
+type setting struct {
+	key       string
+	envs      []string
+	isSecret  bool
+	canReload bool
+	set       func(c *RuntimeConfig, v string) error
+	get       func(c RuntimeConfig) any
+	keep      func(dst *RuntimeConfig, src RuntimeConfig)
+}
+
+func (s setting) secret() setting     { s.isSecret = true; return s }
+func (s setting) reloadable() setting { s.canReload = true; return s }
+
+func field[T any](key string, ptr func(*RuntimeConfig) *T, parse func(string) (T, error), envs ...string) setting {
+	return setting{
+		key:  key,
+		envs: envs,
+		set: func(c *RuntimeConfig, v string) error {
+			x, err := parse(v)
+			if err != nil {
+				return err
+			}
+			*ptr(c) = x
+			return nil
+		},
+		get:  func(c RuntimeConfig) any { return *ptr(&c) },
+		keep: func(dst *RuntimeConfig, src RuntimeConfig) { *ptr(dst) = *ptr(&src) },
+	}
+}
+
+func parseString(v string) (string, error) { return strings.TrimSpace(v), nil }
+
+func parseURL(v string) (string, error) {
+	v = strings.TrimRight(strings.TrimSpace(v), "/")
+	if v == "" {
+		return "", nil
+	}
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%q is not an http(s) URL", v)
+	}
+	return v, nil
+}
+
+func parseIntValue(v string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an integer", v)
+	}
+	return n, nil
+}
+
+// parseDurationIn accepts Go durations ("90s", "1m") or a bare number in unit, which
+// keeps the older *_SECONDS / *_MS variables working.
+func parseDurationIn(unit time.Duration) func(string) (time.Duration, error) {
+	return func(v string) (time.Duration, error) {
+		v = strings.TrimSpace(v)
+		if n, err := strconv.ParseFloat(v, 64); err == nil {
+			return time.Duration(n * float64(unit)), nil
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a duration", v)
+		}
+		return d, nil
+	}
+}
+
+func parseList(v string) ([]string, error) { return splitCSV(v), nil }
+
+// parseModelFallbacks reads "route=model,model;route=model".
+func parseModelFallbacks(v string) (map[string][]string, error) {
+	out := map[string][]string{}
+	for _, part := range strings.Split(v, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		route, models, ok := strings.Cut(part, "=")
+		route = strings.TrimSpace(route)
+		if !ok || route == "" {
+			return nil, fmt.Errorf("%q is not route=model[,model]", part)
+		}
+		out[route] = splitCSV(models)
+	}
+	return out, nil
+}
+
+func parseHTTPAddr(v string) (string, error) {
+	v = strings.TrimSpace(v)
+	if _, err := strconv.Atoi(v); err == nil {
+		return ":" + v, nil
+	}
+	return v, nil
+}
+
+var settings = []setting{
+	field("supabase.url", func(c *RuntimeConfig) *string { return &c.SupabaseURL }, parseURL, "SUPABASE_URL").secret(),
+	field("supabase.service_role", func(c *RuntimeConfig) *string { return &c.SupabaseServiceRole }, parseString, "SUPABASE_SERVICE_ROLE", "SUPABASE_SERVICE_ROLE_KEY").secret(),
+	field("openai.api_key", func(c *RuntimeConfig) *string { return &c.OpenAIAPIKey }, parseString, "OPENAI_API_KEY").secret(),
+	field("openai.base_url", func(c *RuntimeConfig) *string { return &c.OpenAIBaseURL }, parseURL, "OPENAI_BASE_URL"),
+	field("openai.preferred_model", func(c *RuntimeConfig) *string { return &c.PreferredModel }, parseString, "PREFERRED_MODEL").reloadable(),
+	field("openai.extractor_model", func(c *RuntimeConfig) *string { return &c.ExtractorModel }, parseString, "EXTRACTOR_MODEL").reloadable(),
+	field("openai.model_fallbacks", func(c *RuntimeConfig) *map[string][]string { return &c.ModelFallbacks }, parseModelFallbacks, "MODEL_FALLBACKS").reloadable(),
+	field("openai.chat_timeout", func(c *RuntimeConfig) *time.Duration { return &c.ChatModelTimeout }, parseDurationIn(time.Second), "CHAT_MODEL_TIMEOUT_SECONDS").reloadable(),
+	field("openai.models_ttl", func(c *RuntimeConfig) *time.Duration { return &c.ModelsTTL }, parseDurationIn(time.Second), "MODELS_CACHE_TTL").reloadable(),
+	field("openai.capabilities_file", func(c *RuntimeConfig) *string { return &c.CapabilitiesFile }, parseString, "MODEL_CAPABILITIES_FILE").reloadable(),
+	field("budget.global", func(c *RuntimeConfig) *budgetLimits { return &c.BudgetGlobal }, parseBudget, "BUDGET_GLOBAL").reloadable(),
+	field("budget.tenant", func(c *RuntimeConfig) *budgetLimits { return &c.BudgetTenant }, parseBudget, "BUDGET_TENANT").reloadable(),
+	field("budget.user", func(c *RuntimeConfig) *budgetLimits { return &c.BudgetUser }, parseBudget, "BUDGET_USER").reloadable(),
+	field("budget.soft_percent", func(c *RuntimeConfig) *int { return &c.BudgetSoftPercent }, parseIntValue, "BUDGET_SOFT_PERCENT").reloadable(),
+	field("budget.soft_model", func(c *RuntimeConfig) *string { return &c.BudgetSoftModel }, parseString, "BUDGET_SOFT_MODEL").reloadable(),
+	field("phone.default_country", func(c *RuntimeConfig) *string { return &c.PhoneDefaultCountry }, parseString, "PHONE_DEFAULT_COUNTRY").reloadable(),
+	field("email.domain_rules", func(c *RuntimeConfig) *map[string]emailRule { return &c.EmailDomainRules }, parseEmailRules, "EMAIL_DOMAIN_RULES").reloadable(),
+	field("email.disposable_domains", func(c *RuntimeConfig) *[]string { return &c.EmailDisposable }, func(v string) ([]string, error) { return splitCSV(strings.ToLower(v)), nil }, "EMAIL_DISPOSABLE_DOMAINS").reloadable(),
+	field("extraction.confirm_below", func(c *RuntimeConfig) *int { return &c.ConfirmBelow }, parseIntValue, "EXTRACTION_CONFIRM_BELOW").reloadable(),
+	field("moderation.classifier", func(c *RuntimeConfig) *string { return &c.Moderation }, parseString, "MODERATION_CLASSIFIER").reloadable(),
+	field("moderation.model", func(c *RuntimeConfig) *string { return &c.ModerationModel }, parseString, "MODERATION_MODEL").reloadable(),
+	field("moderation.policy", func(c *RuntimeConfig) *map[string]string { return &c.ModerationPolicy }, parseModerationPolicy, "MODERATION_POLICY").reloadable(),
+	field("http.ui_origins", func(c *RuntimeConfig) *[]string { return &c.UIOrigins }, parseList, "UI_ORIGINS").reloadable(),
+	field("http.addr", func(c *RuntimeConfig) *string { return &c.HTTP.Addr }, parseHTTPAddr, "LISTEN_ADDR", "PORT"),
+	field("http.read_timeout", func(c *RuntimeConfig) *time.Duration { return &c.HTTP.ReadTimeout }, parseDurationIn(time.Second), "HTTP_READ_TIMEOUT"),
+	field("http.read_header_timeout", func(c *RuntimeConfig) *time.Duration { return &c.HTTP.ReadHeaderTimeout }, parseDurationIn(time.Second), "HTTP_READ_HEADER_TIMEOUT"),
+	field("http.write_timeout", func(c *RuntimeConfig) *time.Duration { return &c.HTTP.WriteTimeout }, parseDurationIn(time.Second), "HTTP_WRITE_TIMEOUT"),
+	field("http.idle_timeout", func(c *RuntimeConfig) *time.Duration { return &c.HTTP.IdleTimeout }, parseDurationIn(time.Second), "HTTP_IDLE_TIMEOUT"),
+	field("http.max_header_bytes", func(c *RuntimeConfig) *int { return &c.HTTP.MaxHeaderBytes }, parseIntValue, "HTTP_MAX_HEADER_BYTES"),
+	field("http.max_body_bytes", func(c *RuntimeConfig) *int64 { return &c.HTTP.MaxBodyBytes }, func(v string) (int64, error) { n, err := parseIntValue(v); return int64(n), err }, "HTTP_MAX_BODY_BYTES"),
+	field("http.shutdown_timeout", func(c *RuntimeConfig) *time.Duration { return &c.HTTP.ShutdownTimeout }, parseDurationIn(time.Second), "SHUTDOWN_TIMEOUT"),
+	field("http.drain_delay", func(c *RuntimeConfig) *time.Duration { return &c.HTTP.DrainDelay }, parseDurationIn(time.Second), "SHUTDOWN_DRAIN_DELAY"),
+	field("http.tls_cert_file", func(c *RuntimeConfig) *string { return &c.HTTP.TLSCertFile }, parseString, "TLS_CERT_FILE"),
+	field("http.tls_key_file", func(c *RuntimeConfig) *string { return &c.HTTP.TLSKeyFile }, parseString, "TLS_KEY_FILE"),
+	field("http.metrics_addr", func(c *RuntimeConfig) *string { return &c.HTTP.MetricsAddr }, parseHTTPAddr, "METRICS_ADDR"),
+	field("upstream.max_retries", func(c *RuntimeConfig) *int { return &c.UpstreamMaxRetries }, parseIntValue, "UPSTREAM_MAX_RETRIES").reloadable(),
+	field("upstream.retry_base", func(c *RuntimeConfig) *time.Duration { return &c.UpstreamRetryBase }, parseDurationIn(time.Millisecond), "UPSTREAM_RETRY_BASE_MS").reloadable(),
+	field("upstream.retry_max", func(c *RuntimeConfig) *time.Duration { return &c.UpstreamRetryMax }, parseDurationIn(time.Millisecond), "UPSTREAM_RETRY_MAX_MS").reloadable(),
+	field("upstream.breaker_threshold", func(c *RuntimeConfig) *int { return &c.BreakerThreshold }, parseIntValue, "BREAKER_FAILURE_THRESHOLD").reloadable(),
+	field("upstream.breaker_cooldown", func(c *RuntimeConfig) *time.Duration { return &c.BreakerCooldown }, parseDurationIn(time.Second), "BREAKER_COOLDOWN_SECONDS").reloadable(),
+	field("log.level", func(c *RuntimeConfig) *string { return &c.LogLevel }, parseString, "LOG_LEVEL").reloadable(),
+	field("log.format", func(c *RuntimeConfig) *string { return &c.LogFormat }, parseString, "LOG_FORMAT"),
+	field("tracing.exporter", func(c *RuntimeConfig) *string { return &c.TraceExporter }, parseString, "OTEL_TRACES_EXPORTER"),
+	field("tracing.endpoint", func(c *RuntimeConfig) *string { return &c.TraceEndpoint }, parseURL, "OTEL_EXPORTER_OTLP_ENDPOINT"),
+	field("tracing.service_name", func(c *RuntimeConfig) *string { return &c.ServiceName }, parseString, "OTEL_SERVICE_NAME"),
+	field("outbox.path", func(c *RuntimeConfig) *string { return &c.OutboxPath }, parseString, "OUTBOX_PATH"),
+	field("admin.token", func(c *RuntimeConfig) *string { return &c.AdminToken }, parseString, "ADMIN_TOKEN").secret(),
+	field("tenants.file", func(c *RuntimeConfig) *string { return &c.TenantsFile }, parseString, "TENANTS_FILE").reloadable(),
+}
+
+func settingByKey(key string) (setting, bool) {
+	for _, s := range settings {
+		if s.key == key {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// configSources names the files a load reads; empty paths are skipped.
+type configSources struct {
+	File   string
+	DotEnv string
+}
+
+func defaultConfigSources() configSources {
+	src := configSources{File: getenv("CONFIG_FILE", ""), DotEnv: ".env"}
+	if src.File == "" {
+		for _, p := range []string{"config.toml", "config.yaml", "config.yml"} {
+			if _, err := os.Stat(p); err == nil {
+				src.File = p
+				break
+			}
+		}
+	}
+	return src
+}
+
+// loadConfig builds and validates a configuration from every layer. All problems are
+// reported together, one per line.
+func loadConfig(src configSources, overrides map[string]string) (RuntimeConfig, error) {
+	c := defaultConfig()
+	problems := []string{}
+	fileVals := map[string]string{}
+	if src.File != "" {
+		vals, err := parseConfigFile(src.File)
+		if err != nil {
+			return c, fmt.Errorf("config file %s: %w", src.File, err)
+		}
+		fileVals = foldModelFallbacks(vals)
+		for k := range fileVals {
+			if _, ok := settingByKey(k); !ok {
+				problems = append(problems, fmt.Sprintf("%s: unknown setting in %s", k, src.File))
+			}
+		}
+	}
+	dotenv := parseDotEnvFile(src.DotEnv)
+	for _, s := range settings {
+		v, from, ok := "", "", false
+		if fv, found := fileVals[s.key]; found {
+			v, from, ok = fv, src.File, true
+		}
+		for _, e := range s.envs {
+			if dv := strings.TrimSpace(dotenv[e]); dv != "" {
+				v, from, ok = dv, ".env "+e, true
+				break
+			}
+		}
+		for _, e := range s.envs {
+			if ev := strings.TrimSpace(os.Getenv(e)); ev != "" {
+				v, from, ok = ev, "env "+e, true
+				break
+			}
+		}
+		if ov, found := overrides[s.key]; found && !s.isSecret {
+			v, from, ok = ov, "admin override", true
+		}
+		if !ok {
+			continue
+		}
+		if err := s.set(&c, v); err != nil {
+			problems = append(problems, fmt.Sprintf("%s (from %s): %v", s.key, from, err))
+		}
+	}
+	caps, err := loadCapabilities(c.CapabilitiesFile)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("openai.capabilities_file: %v", err))
+	} else {
+		c.ModelCapabilities = caps
+		problems = append(problems, validateCapabilities(caps)...)
+	}
+	if c.TenantsFile != "" {
+		lookup := func(k string) string { return ternary(os.Getenv(k) != "", os.Getenv(k), dotenv[k]) }
+		ts, err := loadTenants(c.TenantsFile, lookup)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("tenants.file: %v", err))
+		}
+		c.Tenants = ts
+		problems = append(problems, validateTenants(ts)...)
+	}
+	problems = append(problems, validateConfig(c)...)
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return c, errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return c, nil
+}
+
+func validateConfig(c RuntimeConfig) []string {
+	p := []string{}
+	req := func(cond bool, key, msg string) {
+		if !cond {
+			p = append(p, key+": "+msg)
+		}
+	}
+	req(c.OpenAIBaseURL != "", "openai.base_url", "must be set")
+	req(c.PreferredModel != "", "openai.preferred_model", "must be set")
+	req(c.ExtractorModel != "", "openai.extractor_model", "must be set")
+	req(c.ChatModelTimeout > 0, "openai.chat_timeout", "must be positive")
+	req(c.ModelsTTL >= 10*time.Second, "openai.models_ttl", "must be at least 10s")
+	req(c.BudgetSoftPercent >= 1 && c.BudgetSoftPercent <= 100, "budget.soft_percent", "must be between 1 and 100")
+	req(c.BudgetSoftModel != "", "budget.soft_model", "must be set")
+	req(c.PhoneDefaultCountry == "" || countryCode(c.PhoneDefaultCountry) != "", "phone.default_country", fmt.Sprintf("%q is not a supported country code", c.PhoneDefaultCountry))
+	req(c.ConfirmBelow >= 0 && c.ConfirmBelow <= 101, "extraction.confirm_below", "must be between 0 (never confirm) and 101 (always confirm)")
+	req(c.Moderation == "none" || c.Moderation == "local" || c.Moderation == "openai", "moderation.classifier", "must be none, local or openai")
+	req(c.Moderation != "openai" || c.ModerationModel != "", "moderation.model", "must be set for the openai classifier")
+	for _, o := range c.UIOrigins {
+		if o != "file://" {
+			u, err := url.Parse(o)
+			req(err == nil && u.Scheme != "" && u.Host != "", "http.ui_origins", fmt.Sprintf("%q is not an origin (scheme://host[:port])", o))
+		}
+	}
+	req(c.HTTP.Addr != "", "http.addr", "must be set")
+	req(c.HTTP.MetricsAddr == "" || c.HTTP.MetricsAddr != c.HTTP.Addr, "http.metrics_addr", "must differ from http.addr")
+	req(c.HTTP.ReadTimeout >= 0 && c.HTTP.ReadHeaderTimeout >= 0 && c.HTTP.WriteTimeout >= 0 && c.HTTP.IdleTimeout >= 0, "http", "timeouts must not be negative")
+	req(c.HTTP.MaxHeaderBytes > 0, "http.max_header_bytes", "must be positive")
+	req(c.HTTP.MaxBodyBytes > 0, "http.max_body_bytes", "must be positive")
+	req(c.HTTP.ShutdownTimeout > 0, "http.shutdown_timeout", "must be positive")
+	req(c.HTTP.WriteTimeout == 0 || c.HTTP.WriteTimeout >= c.ChatModelTimeout+chatTurnReserve, "http.write_timeout", fmt.Sprintf("must be 0 or at least openai.chat_timeout plus %s for the rest of the turn", chatTurnReserve))
+	req(c.HTTP.DrainDelay >= 0, "http.drain_delay", "must not be negative")
+	req((c.HTTP.TLSCertFile == "") == (c.HTTP.TLSKeyFile == ""), "http.tls_cert_file", "tls_cert_file and tls_key_file must be set together")
+	for _, f := range []string{c.HTTP.TLSCertFile, c.HTTP.TLSKeyFile} {
+		if f != "" {
+			_, err := os.Stat(f)
+			req(err == nil, "http.tls", fmt.Sprintf("cannot read %s", f))
+		}
+	}
+	req(c.UpstreamMaxRetries >= 0 && c.UpstreamMaxRetries <= 10, "upstream.max_retries", "must be between 0 and 10")
+	req(c.UpstreamRetryBase > 0 && c.UpstreamRetryMax >= c.UpstreamRetryBase, "upstream.retry_base", "must be positive and not above upstream.retry_max")
+	req(c.BreakerThreshold >= 1, "upstream.breaker_threshold", "must be at least 1")
+	req(c.BreakerCooldown > 0, "upstream.breaker_cooldown", "must be positive")
+	var lv slog.Level
+	req(lv.UnmarshalText([]byte(c.LogLevel)) == nil, "log.level", fmt.Sprintf("%q is not one of debug, info, warn, error", c.LogLevel))
+	req(c.LogFormat == "json" || c.LogFormat == "text", "log.format", "must be json or text")
+	req(c.TraceExporter == "none" || c.TraceExporter == "stdout" || c.TraceExporter == "otlp", "tracing.exporter", "must be none, stdout or otlp")
+	req(c.TraceExporter != "otlp" || c.TraceEndpoint != "", "tracing.endpoint", "must be set for the otlp exporter")
+	req(c.OutboxPath != "", "outbox.path", "must be set")
+	return p
+}
+
+// configWarnings lists settings that are valid but leave features unavailable.
+func configWarnings(c RuntimeConfig) []string {
+	w := []string{}
+	check := func(c RuntimeConfig, prefix string) {
+		if c.OpenAIAPIKey == "" {
+			w = append(w, prefix+"OPENAI_API_KEY is not set; chat and models endpoints will fail")
+		}
+		if c.SupabaseURL == "" || c.SupabaseServiceRole == "" {
+			w = append(w, prefix+"SUPABASE_URL / SUPABASE_SERVICE_ROLE are not set; storage endpoints will fail")
+		}
+		if _, ok := c.capability(c.PreferredModel); !ok {
+			w = append(w, prefix+"preferred model "+c.PreferredModel+" has no capability entry; clients will not be offered it")
+		}
+		if cap, ok := c.capability(c.ExtractorModel); ok && !cap.JSONSchema {
+			w = append(w, prefix+"extractor model "+c.ExtractorModel+" does not support JSON schema output")
+		}
+	}
+	if len(c.Tenants) == 0 {
+		check(c, "")
+	}
+	for _, t := range c.Tenants {
+		check(tenantConfig(c, t), "tenant "+t.ID+": ")
+	}
+	return w
+}
+
+func getConfig() RuntimeConfig { cfgMu.RLock(); defer cfgMu.RUnlock(); return cfg }
+
+func setConfig(c RuntimeConfig) {
+	cfgMu.Lock()
+	cfg = c
+	cfgMu.Unlock()
+	var lv slog.Level
+	if lv.UnmarshalText([]byte(c.LogLevel)) == nil {
+		logLevel.Set(lv)
+	}
+}
+
+// updateConfig applies fn to a copy of the current configuration and installs it.
+func updateConfig(fn func(c *RuntimeConfig)) {
+	c := getConfig()
+	fn(&c)
+	setConfig(c)
+}
+
+// reloadMu serialises SIGHUP reloads and admin overrides, so each installs a
+// configuration built from the other's latest state.
+var reloadMu sync.Mutex
+
+// reloadConfig re-reads every layer and applies the reloadable settings. Settings that
+// need a restart keep their running value and are reported.
+func reloadConfig(src configSources) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	if err := applyConfig(src, overridesSnapshot()); err != nil {
+		return err
+	}
+	logger.Info("config reloaded", "file", src.File)
+	return nil
+}
+
+// applyConfig builds the configuration with overrides on top and installs it together
+// with overrides, or changes nothing. Callers hold reloadMu.
+func applyConfig(src configSources, overrides map[string]string) error {
+	next, err := loadConfig(src, overrides)
+	if err != nil {
+		return err
+	}
+	cur := getConfig()
+	for _, s := range settings {
+		if s.canReload {
+			continue
+		}
+		if fmt.Sprint(s.get(cur)) != fmt.Sprint(s.get(next)) {
+			logger.Warn("config change needs a restart", "setting", s.key)
+		}
+		s.keep(&next, cur)
+	}
+	keepTenantSecrets(next.Tenants, cur.Tenants)
+	cfgMu.Lock()
+	adminOverrides = overrides
+	cfgMu.Unlock()
+	setConfig(next)
+	return nil
+}
+
+func overridesSnapshot() map[string]string {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	out := make(map[string]string, len(adminOverrides))
+	for k, v := range adminOverrides {
+		out[k] = v
+	}
+	return out
+}
+
+// setOverrides validates admin overrides for reloadable, non-secret settings and
+// applies all of them or none. An empty value removes an override.
+func setOverrides(in map[string]string) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	next := overridesSnapshot()
+	problems := []string{}
+	for _, key := range sortedKeys(in) {
+		s, ok := settingByKey(key)
+		switch {
+		case !ok:
+			problems = append(problems, key+": unknown setting")
+		case s.isSecret || !s.canReload:
+			problems = append(problems, key+" cannot be changed at runtime")
+		case in[key] == "":
+			delete(next, key)
+		default:
+			next[key] = in[key]
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return applyConfig(defaultConfigSources(), next)
+}
+
+func maskConfig(c RuntimeConfig) map[string]any {
+	effective := map[string]any{}
+	for _, s := range settings {
+		if !s.isSecret {
+			v := s.get(c)
+			if d, ok := v.(time.Duration); ok {
+				v = d.String()
+			}
+			effective[s.key] = v
+		}
+	}
+	return map[string]any{
+		"preferred_model":           c.PreferredModel,
+		"has_openai_key":            strings.TrimSpace(c.OpenAIAPIKey) != "",
+		"has_supabase_url":          strings.TrimSpace(c.SupabaseURL) != "",
+		"has_supabase_service_role": strings.TrimSpace(c.SupabaseServiceRole) != "",
+		"has_admin_token":           strings.TrimSpace(c.AdminToken) != "",
+		"effective":                 effective,
+	}
+}
+
+func adminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method == http.MethodPost {
+		var in map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeJSON(w, 400, map[string]any{"detail": "expected a JSON object of setting key to string value"})
+			return
+		}
+		if err := setOverrides(in); err != nil {
+			writeJSON(w, 400, map[string]any{"detail": err.Error()})
+			return
+		}
+		for _, k := range sortedKeys(in) {
+			logFrom(r.Context()).Info("config override set", "setting", k)
+		}
+	}
+	writeJSON(w, 200, map[string]any{"config": maskConfig(getConfig()), "overrides": overridesSnapshot(), "tenants": tenantSummaries(getConfig().Tenants)})
+}
+
+// parseDotEnvFile reads KEY=value lines; a missing file yields an empty map.
+func parseDotEnvFile(path string) map[string]string {
+	out := map[string]string{}
+	if path == "" {
+		return out
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return out
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "export ") {
+			line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key := strings.TrimSpace(k)
+		if key == "" {
+			continue
+		}
+		val := strings.TrimSpace(v)
+		val = strings.Trim(val, `"'`)
+		out[key] = val
+	}
+	return out
+}
+
+// parseConfigFile flattens a TOML or YAML file (chosen by extension) into dotted keys.
+// Only the subset the settings need is supported: tables/mappings, scalars and lists.
+func parseConfigFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return parseYAMLSubset(string(b))
+	default:
+		return parseTOMLSubset(string(b))
+	}
+}
+
+func parseTOMLSubset(src string) (map[string]string, error) {
+	out := map[string]string{}
+	section := ""
+	for i, raw := range strings.Split(src, "\n") {
+		line := strings.TrimSpace(stripComment(raw))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: unterminated table header", i+1)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", i+1)
+		}
+		val, err := scalarOrList(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		out[joinKey(section, strings.Trim(strings.TrimSpace(k), `"`))] = val
+	}
+	return out, nil
+}
+
+func parseYAMLSubset(src string) (map[string]string, error) {
+	out := map[string]string{}
+	type level struct {
+		indent int
+		key    string
+	}
+	stack := []level{}
+	lastKey := ""
+	for i, raw := range strings.Split(src, "\n") {
+		line := stripComment(raw)
+		if strings.TrimSpace(line) == "" || strings.TrimSpace(line) == "---" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		text := strings.TrimSpace(line)
+		if strings.HasPrefix(text, "- ") {
+			if lastKey == "" {
+				return nil, fmt.Errorf("line %d: list item without a key", i+1)
+			}
+			item, err := scalarOrList(strings.TrimSpace(text[2:]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+			out[lastKey] = strings.TrimPrefix(out[lastKey]+","+item, ",")
+			continue
+		}
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		k, v, ok := strings.Cut(text, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", i+1)
+		}
+		parent := ""
+		if len(stack) > 0 {
+			parent = stack[len(stack)-1].key
+		}
+		key := joinKey(parent, strings.Trim(strings.TrimSpace(k), `"'`))
+		v = strings.TrimSpace(v)
+		if v == "" {
+			stack = append(stack, level{indent: indent, key: key})
+			lastKey = key
+			out[key] = ""
+			continue
+		}
+		val, err := scalarOrList(v)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		out[key] = val
+		lastKey = key
+	}
+	// Mapping headers were recorded so block lists could attach to them; drop the
+	// ones that turned out to be plain parents.
+	for k, v := range out {
+		if v == "" {
+			for other := range out {
+				if strings.HasPrefix(other, k+".") {
+					delete(out, k)
+					break
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// scalarOrList decodes a quoted/bare scalar or an inline [a, b] list (joined by commas).
+func scalarOrList(v string) (string, error) {
+	if strings.HasPrefix(v, "[") {
+		if !strings.HasSuffix(v, "]") {
+			return "", errors.New("unterminated list")
+		}
+		items := []string{}
+		for _, it := range strings.Split(v[1:len(v)-1], ",") {
+			if it = strings.TrimSpace(it); it == "" {
+				continue
+			}
+			s, err := unquote(it)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	}
+	return unquote(v)
+}
+
+func unquote(v string) (string, error) {
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		return strconv.Unquote(v)
+	}
+	if len(v) >= 2 && v[0] == '\'' && v[len(v)-1] == '\'' {
+		return v[1 : len(v)-1], nil
+	}
+	return v, nil
+}
+
+// stripComment removes a trailing # comment that is not inside quotes.
+func stripComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case quote == 0 && r == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func joinKey(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+// foldModelFallbacks turns an [openai.model_fallbacks] table (route = [models]) into
+// the single "route=a,b;route=c" value the setting parses.
+func foldModelFallbacks(vals map[string]string) map[string]string {
+	const prefix = "openai.model_fallbacks."
+	parts := []string{}
+	for _, k := range sortedKeys(vals) {
+		if strings.HasPrefix(k, prefix) {
+			parts = append(parts, strings.TrimPrefix(k, prefix)+"="+vals[k])
+			delete(vals, k)
+		}
+	}
+	if len(parts) > 0 {
+		vals["openai.model_fallbacks"] = strings.Join(parts, ";")
+	}
+	return vals
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfigSubsets(t *testing.T) {
+	toml := `
+# comment
+log_level = "debug"
+[http]
+addr = ":9000" # trailing comment
+[models]
+allowed = ["gpt-5-mini", "gpt-5"]
+`
+	yaml := `
+log_level: debug
+http:
+  addr: ":9000"
+models:
+  allowed:
+    - gpt-5-mini
+    - gpt-5
+`
+	want := map[string]string{"log_level": "debug", "http.addr": ":9000", "models.allowed": "gpt-5-mini,gpt-5"}
+	for name, parse := range map[string]func() (map[string]string, error){
+		"toml": func() (map[string]string, error) { return parseTOMLSubset(toml) },
+		"yaml": func() (map[string]string, error) { return parseYAMLSubset(yaml) },
+	} {
+		got, err := parse()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("%s: %s = %q, want %q", name, k, got[k], v)
+			}
+		}
+	}
+	if _, err := parseTOMLSubset("[http\naddr = 1"); err == nil {
+		t.Error("unterminated TOML table header accepted")
+	}
+	if _, err := parseYAMLSubset("- orphan"); err == nil {
+		t.Error("YAML list item without a key accepted")
+	}
+}
+
+func TestValueParsers(t *testing.T) {
+	if d, err := parseDurationIn(time.Second)("1.5"); err != nil || d != 1500*time.Millisecond {
+		t.Errorf(`parseDurationIn(s)("1.5") = %v, %v`, d, err)
+	}
+	if d, err := parseDurationIn(time.Second)("2m"); err != nil || d != 2*time.Minute {
+		t.Errorf(`parseDurationIn(s)("2m") = %v, %v`, d, err)
+	}
+	if _, err := parseDurationIn(time.Second)("soon"); err == nil {
+		t.Error(`parseDurationIn accepted "soon"`)
+	}
+
+	fb, err := parseModelFallbacks("default=gpt-5-mini,gpt-4.1-mini; order_support=gpt-5")
+	if want := map[string][]string{"default": {"gpt-5-mini", "gpt-4.1-mini"}, "order_support": {"gpt-5"}}; err != nil || !reflect.DeepEqual(fb, want) {
+		t.Errorf("parseModelFallbacks = %v, %v; want %v", fb, err, want)
+	}
+	if _, err := parseModelFallbacks("gpt-5"); err == nil {
+		t.Error("parseModelFallbacks accepted a part without a route")
+	}
+
+	b, err := parseBudget("daily_usd=5, monthly_tokens=2000000")
+	if want := (budgetLimits{DailyUSD: 5, MonthlyTokens: 2000000}); err != nil || b != want {
+		t.Errorf("parseBudget = %+v, %v; want %+v", b, err, want)
+	}
+	for _, bad := range []string{"daily_usd=-1", "weekly_usd=3", "daily_usd=lots"} {
+		if _, err := parseBudget(bad); err == nil {
+			t.Errorf("parseBudget(%q) accepted", bad)
+		}
+	}
+
+	mp, err := parseModerationPolicy("harassment=block, violence=warn")
+	if want := map[string]string{"harassment": "block", "violence": "warn"}; err != nil || !reflect.DeepEqual(mp, want) {
+		t.Errorf("parseModerationPolicy = %v, %v; want %v", mp, err, want)
+	}
+	for _, bad := range []string{"spam=block", "hate=ignore"} {
+		if _, err := parseModerationPolicy(bad); err == nil {
+			t.Errorf("parseModerationPolicy(%q) accepted", bad)
+		}
+	}
+
+	er, err := parseEmailRules("example.org=dots,plus;corp.example=tag:-,alias:example.com")
+	want := map[string]emailRule{"example.org": {IgnoreDots: true, TagSep: "+"}, "corp.example": {TagSep: "-", Alias: "example.com"}}
+	if err != nil || !reflect.DeepEqual(er, want) {
+		t.Errorf("parseEmailRules = %v, %v; want %v", er, err, want)
+	}
+	if _, err := parseEmailRules("example.org=fold"); err == nil {
+		t.Error("parseEmailRules accepted an unknown option")
+	}
+}
+
+func TestValidateWriteTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		write, chat time.Duration
+		ok          bool
+	}{
+		{180 * time.Second, 60 * time.Second, true},
+		{0, 60 * time.Second, true},
+		{60 * time.Second, 60 * time.Second, false},
+		{75 * time.Second, 60 * time.Second, true},
+	} {
+		c := defaultConfig()
+		c.HTTP.WriteTimeout, c.ChatModelTimeout = tc.write, tc.chat
+		bad := false
+		for _, p := range validateConfig(c) {
+			bad = bad || strings.HasPrefix(p, "http.write_timeout")
+		}
+		if bad == tc.ok {
+			t.Errorf("write_timeout %v with chat_timeout %v: rejected = %v, want %v", tc.write, tc.chat, bad, !tc.ok)
+		}
+	}
+}
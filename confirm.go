@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// Identity fields the extractor is unsure of are not written to app_users straight
+// away. They wait in the conversation's metadata.pending_fields while the bot asks
+// the user to confirm them, one per turn; a yes commits the value, a no or a
+// different value rejects it. Both outcomes are recorded as identity events.
+
+var identityFields = []string{"email", "phone", "name"}
+
+// maxConfirmAsks is how many times a field is asked about before it is dropped.
+const maxConfirmAsks = 2
+
+type pendingField struct {
+	Value      string `json:"value"`
+	Confidence int    `json:"confidence"`
+	Reason     string `json:"reason"`
+	Original   string `json:"original,omitempty"`
+	Asks       int    `json:"asks,omitempty"`
+	Asking     bool   `json:"asking,omitempty"`
+}
+
+type identityEvent struct {
+	Type    string
+	Payload map[string]any
+}
+
+// identityReview is what a turn does with identity fields: Commit holds the fields
+// for applyExtractedFields, Pending what is still unconfirmed.
+type identityReview struct {
+	Commit  map[string]any
+	Pending map[string]pendingField
+	Asking  string
+	Events  []identityEvent
+	Changed bool
+}
+
+// confirmYes must match the whole reply, so "ok but my number is actually …" or
+// "right, no wait" do not confirm anything; confirmNo only needs to lead it.
+var (
+	confirmYes = regexp.MustCompile(`(?i)^\s*(yes|yeah|yep|yup|y|correct|right|that['’]?s right|that is right|that['’]?s correct|that['’]?s it|exactly|sure|confirm(ed)?|ok(ay)?)([\s,.!]+(yes|please|thanks|thank you|it is|that['’]?s right|that['’]?s correct|that['’]?s it|correct|exactly))*[\s.!]*$`)
+	confirmNo  = regexp.MustCompile(`(?i)^\s*(no|nope|nah|n|wrong|incorrect|not right|that's wrong|that's not|that is not)\b`)
+)
+
+func pendingFields(convMeta map[string]any) map[string]pendingField {
+	out := map[string]pendingField{}
+	if v, ok := convMeta["pending_fields"]; ok {
+		b, _ := json.Marshal(v)
+		_ = json.Unmarshal(b, &out)
+	}
+	if out == nil {
+		out = map[string]pendingField{} // "pending_fields": null
+	}
+	return out
+}
+
+// reviewIdentityFields decides which of this turn's identity fields are committed
+// and which wait for confirmation (confidence below threshold, needs_verification,
+// or an email typo suggestion), and settles the confirmation asked last turn using
+// the user's reply.
+func reviewIdentityFields(extracted, convMeta map[string]any, message string, threshold int, c RuntimeConfig) identityReview {
+	r := identityReview{Commit: merge(nil, extracted), Pending: pendingFields(convMeta)}
+	for _, f := range identityFields {
+		r.Commit[f] = nil
+	}
+	commit := func(f, value string, confidence int, confirmed bool) {
+		r.Commit[f] = value
+		r.Commit["confidence"] = max(toInt(r.Commit["confidence"]), confidence)
+		if f == "email" && confirmed {
+			e := analyzeEmail(value, c)
+			r.Commit["email_canonical"], r.Commit["email_disposable"] = e.Canonical, ternary[any](e.Disposable, true, nil)
+		}
+		r.Events = append(r.Events, identityEvent{"identity.field_committed", map[string]any{"field": f, "value": value, "confidence": confidence, "confirmed": confirmed}})
+	}
+	reject := func(f, reason string) {
+		p := r.Pending[f]
+		delete(r.Pending, f)
+		r.Changed = true
+		r.Events = append(r.Events, identityEvent{"identity.field_rejected", map[string]any{"field": f, "value": p.Value, "confidence": p.Confidence, "reason": reason}})
+	}
+
+	for _, f := range identityFields {
+		p, ok := r.Pending[f]
+		if !ok || !p.Asking {
+			continue
+		}
+		newValue := asString(extracted[f])
+		if f == "email" && extracted["email_suggestion"] != nil {
+			newValue = ""
+		}
+		switch {
+		case newValue != "" && newValue != p.Value:
+			reject(f, "corrected")
+		case confirmYes.MatchString(message):
+			delete(r.Pending, f)
+			r.Changed = true
+			commit(f, p.Value, 100, true)
+		case confirmNo.MatchString(message):
+			reject(f, "declined")
+			// Declining a typo suggestion confirms the address as typed.
+			if p.Original != "" {
+				commit(f, p.Original, 100, true)
+			}
+		case p.Asks >= maxConfirmAsks:
+			reject(f, "unanswered")
+		}
+	}
+
+	for _, f := range identityFields {
+		conf := fieldConfidence(extracted, f)
+		unsure := conf < threshold || extracted["needs_verification"] == true
+		value, reason, original := asString(extracted[f]), ternary(conf < threshold, "low_confidence", "needs_verification"), ""
+		if f == "email" && extracted["email_suggestion"] != nil {
+			value, reason, original = asString(extracted["email_suggestion"]), "typo_suggestion", analyzeEmail(asString(extracted["email_raw"]), c).Address
+		}
+		switch {
+		case value == "" || value == r.Commit[f]:
+		case reason == "typo_suggestion" || unsure:
+			if p, ok := r.Pending[f]; !ok || p.Value != value {
+				r.Pending[f] = pendingField{Value: value, Confidence: conf, Reason: reason, Original: original}
+				r.Changed = true
+				r.Events = append(r.Events, identityEvent{"identity.field_pending", map[string]any{"field": f, "value": value, "confidence": conf, "reason": reason}})
+			}
+		default:
+			if _, ok := r.Pending[f]; ok {
+				delete(r.Pending, f)
+				r.Changed = true
+			}
+			commit(f, value, conf, false)
+		}
+	}
+
+	// One confirmation question per turn: keep asking the current one, else start
+	// on the next pending field.
+	for _, f := range identityFields {
+		if p, ok := r.Pending[f]; ok && p.Asking {
+			r.Asking = f
+		}
+	}
+	if r.Asking == "" {
+		for _, f := range identityFields {
+			if _, ok := r.Pending[f]; ok {
+				r.Asking = f
+				break
+			}
+		}
+	}
+	if r.Asking != "" {
+		p := r.Pending[r.Asking]
+		p.Asking, p.Asks = true, p.Asks+1
+		r.Pending[r.Asking] = p
+		r.Changed = true
+	}
+	if len(r.Pending) > 0 {
+		pending := map[string]any{}
+		for f, p := range r.Pending {
+			pending[f] = p.Value
+		}
+		extracted["pending_confirmation"] = pending
+	}
+	return r
+}
+
+// note asks the chat model to confirm the pending field. Email typos are already
+// covered by the typo note.
+func (r identityReview) note(extracted map[string]any) string {
+	if r.Asking == "" || r.Asking == "email" && extracted["email_suggestion"] != nil {
+		return ""
+	}
+	label := ternary(r.Asking == "phone", "phone number", r.Asking)
+	return fmt.Sprintf("Before saving it, confirm the user's %s with them: ask \"Is your %s %s?\" and nothing else.", label, label, r.Pending[r.Asking].Value)
+}
+
+// save stores the pending fields in convMeta and records the turn's identity events.
+func (r identityReview) save(ctx context.Context, client *http.Client, userID, convID string, convMeta map[string]any) {
+	if len(r.Pending) == 0 {
+		delete(convMeta, "pending_fields")
+	} else {
+		convMeta["pending_fields"] = r.Pending
+	}
+	goBackground(ctx, "events.identity", func(ctx context.Context) {
+		for _, e := range r.Events {
+			_ = sbInsertEvent(ctx, client, userID, convID, e.Type, "backend", e.Payload)
+		}
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestReviewIdentityFields(t *testing.T) {
+	c := RuntimeConfig{}
+	events := func(r identityReview) []string {
+		out := []string{}
+		for _, e := range r.Events {
+			out = append(out, e.Type+":"+asString(e.Payload["field"])+":"+asString(e.Payload["reason"]))
+		}
+		return out
+	}
+	// turn runs one turn on top of the pending fields left by prev.
+	turn := func(prev identityReview, extracted map[string]any, message string) identityReview {
+		return reviewIdentityFields(extracted, map[string]any{"pending_fields": prev.Pending}, message, 70, c)
+	}
+
+	r := turn(identityReview{}, map[string]any{"email": "jane@example.com", "field_confidence": map[string]any{"email": 85}, "confidence": 85}, "jane@example.com")
+	if r.Commit["email"] != "jane@example.com" || len(r.Pending) != 0 {
+		t.Errorf("confident email: commit %v, pending %v", r.Commit["email"], r.Pending)
+	}
+
+	r = turn(identityReview{}, map[string]any{"name": "Jane", "confidence": 40}, "I'm Jane")
+	if r.Commit["name"] != nil || r.Asking != "name" || r.Pending["name"].Value != "Jane" {
+		t.Fatalf("unsure name: commit %v, asking %q, pending %v", r.Commit["name"], r.Asking, r.Pending)
+	}
+	yes := turn(r, map[string]any{}, "yes, that's right")
+	if yes.Commit["name"] != "Jane" || len(yes.Pending) != 0 || yes.Asking != "" {
+		t.Errorf("confirmed name: commit %v, pending %v, asking %q", yes.Commit["name"], yes.Pending, yes.Asking)
+	}
+	for _, msg := range []string{"ok but my number is actually different", "right, no wait", "sure, what about my order?"} {
+		if got := turn(r, map[string]any{}, msg); got.Commit["name"] != nil || got.Pending["name"].Value != "Jane" {
+			t.Errorf("%q committed %v", msg, got.Commit["name"])
+		}
+	}
+	for _, msg := range []string{"Yes", "yep, that’s right!", "ok thanks", "correct."} {
+		if got := turn(r, map[string]any{}, msg); got.Commit["name"] != "Jane" {
+			t.Errorf("%q did not confirm", msg)
+		}
+	}
+	no := turn(r, map[string]any{}, "no")
+	if no.Commit["name"] != nil || len(no.Pending) != 0 {
+		t.Errorf("declined name: commit %v, pending %v", no.Commit["name"], no.Pending)
+	}
+	if got := events(no); len(got) != 1 || got[0] != "identity.field_rejected:name:declined" {
+		t.Errorf("declined name events = %v", got)
+	}
+	corrected := turn(r, map[string]any{"name": "Joan", "confidence": 90}, "it's Joan")
+	if corrected.Commit["name"] != "Joan" {
+		t.Errorf("corrected name: commit %v, events %v", corrected.Commit["name"], events(corrected))
+	}
+	unanswered := turn(turn(r, map[string]any{}, "where is my parcel"), map[string]any{}, "hello?")
+	if len(unanswered.Pending) != 0 {
+		t.Errorf("unanswered name still pending after %d asks: %v", maxConfirmAsks, unanswered.Pending)
+	}
+
+	prevLookup := lookupMX
+	defer func() { lookupMX = prevLookup }()
+	lookupMX = func(_ context.Context, name string) ([]*net.MX, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	ex := map[string]any{"email": "jo@gmial.com", "confidence": 90}
+	normalizeExtractedEmail(context.Background(), ex, c)
+	r = turn(identityReview{}, ex, "jo@gmial.com")
+	if r.Pending["email"].Value != "jo@gmail.com" || r.Pending["email"].Reason != "typo_suggestion" {
+		t.Fatalf("typo: pending %v", r.Pending)
+	}
+	if yes := turn(r, map[string]any{}, "yes"); yes.Commit["email"] != "jo@gmail.com" || yes.Commit["email_canonical"] != "jo@gmail.com" {
+		t.Errorf("accepted suggestion: commit %v", yes.Commit)
+	}
+	if no := turn(r, map[string]any{}, "no, it's right"); no.Commit["email"] != "jo@gmial.com" {
+		t.Errorf("declined suggestion: commit %v, events %v", no.Commit["email"], events(no))
+	}
+}
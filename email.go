@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// emailRule says how a mailbox provider treats addresses: whether dots in the local
+// part are ignored, which character starts a sub-address tag ("+" for "john+shop"),
+// and which domain is the canonical one for aliases such as googlemail.com.
+type emailRule struct {
+	IgnoreDots bool   `json:"ignore_dots,omitempty"`
+	TagSep     string `json:"tag_separator,omitempty"`
+	Alias      string `json:"alias_of,omitempty"`
+}
+
+var builtinEmailRules = map[string]emailRule{
+	"gmail.com":      {IgnoreDots: true, TagSep: "+"},
+	"googlemail.com": {IgnoreDots: true, TagSep: "+", Alias: "gmail.com"},
+	"outlook.com":    {TagSep: "+"},
+	"hotmail.com":    {TagSep: "+"},
+	"live.com":       {TagSep: "+"},
+	"icloud.com":     {TagSep: "+"},
+	"me.com":         {TagSep: "+", Alias: "icloud.com"},
+	"mac.com":        {TagSep: "+", Alias: "icloud.com"},
+	"fastmail.com":   {TagSep: "+"},
+	"protonmail.com": {TagSep: "+"},
+	"proton.me":      {TagSep: "+"},
+	"pm.me":          {TagSep: "+", Alias: "proton.me"},
+	"yahoo.com":      {TagSep: "-"},
+}
+
+// parseEmailRules reads "domain=dots,tag:+;domain=alias:gmail.com"; a domain with no
+// options ("example.org=") is matched exactly.
+func parseEmailRules(v string) (map[string]emailRule, error) {
+	out := map[string]emailRule{}
+	for _, part := range strings.Split(v, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		domain, opts, ok := strings.Cut(part, "=")
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if !ok || domain == "" {
+			return nil, fmt.Errorf("%q is not domain=option[,option]", part)
+		}
+		r := emailRule{}
+		for _, o := range splitCSV(opts) {
+			k, val, _ := strings.Cut(o, ":")
+			switch k {
+			case "dots":
+				r.IgnoreDots = true
+			case "plus":
+				r.TagSep = "+"
+			case "tag":
+				r.TagSep = val
+			case "alias":
+				r.Alias = strings.ToLower(val)
+			default:
+				return nil, fmt.Errorf("%s: unknown option %q (dots, plus, tag:<sep>, alias:<domain>)", domain, o)
+			}
+		}
+		out[domain] = r
+	}
+	return out, nil
+}
+
+// disposableDomains are throwaway-mailbox services. Addresses on them are kept but
+// flagged and never used to link identities.
+var disposableDomains = map[string]bool{
+	"mailinator.com": true, "guerrillamail.com": true, "guerrillamail.net": true, "sharklasers.com": true, "grr.la": true,
+	"10minutemail.com": true, "10minutemail.net": true, "temp-mail.org": true, "tempmail.com": true, "tempmail.net": true,
+	"tempail.com": true, "tempr.email": true, "mytemp.email": true, "yopmail.com": true, "yopmail.fr": true,
+	"trashmail.com": true, "trashmail.de": true, "getnada.com": true, "nada.email": true, "dispostable.com": true,
+	"maildrop.cc": true, "throwawaymail.com": true, "fakeinbox.com": true, "mintemail.com": true, "mohmal.com": true,
+	"emailondeck.com": true, "spamgourmet.com": true, "mailnesia.com": true, "discard.email": true, "burnermail.io": true,
+	"getairmail.com": true, "mailcatch.com": true, "spambox.us": true, "incognitomail.org": true, "trbvm.com": true,
+	"mailpoof.com": true, "moakt.com": true, "emailfake.com": true, "inboxkitten.com": true, "33mail.com": true,
+}
+
+// commonEmailDomains are the domains typos are corrected towards.
+var commonEmailDomains = []string{
+	"gmail.com", "googlemail.com", "yahoo.com", "yahoo.co.uk", "yahoo.fr", "hotmail.com", "hotmail.co.uk", "hotmail.fr",
+	"outlook.com", "live.com", "msn.com", "icloud.com", "me.com", "aol.com", "protonmail.com", "proton.me",
+	"gmx.com", "gmx.de", "gmx.net", "web.de", "mail.com", "orange.fr", "free.fr", "comcast.net", "verizon.net", "att.net",
+}
+
+// knownEmailDomains are regional domains of the common providers. They are a single
+// edit away from one another (hotmail.de, hotmail.fr) and never typos.
+var knownEmailDomains = map[string]bool{
+	"hotmail.de": true, "hotmail.it": true, "hotmail.es": true, "hotmail.be": true, "hotmail.nl": true, "hotmail.ca": true,
+	"hotmail.se": true, "hotmail.dk": true, "hotmail.no": true, "hotmail.ch": true, "hotmail.at": true, "hotmail.gr": true,
+	"yahoo.de": true, "yahoo.it": true, "yahoo.es": true, "yahoo.ca": true, "yahoo.in": true, "yahoo.ie": true,
+	"yahoo.co.in": true, "yahoo.co.jp": true, "yahoo.co.nz": true, "yahoo.co.id": true, "yahoo.com.au": true, "yahoo.com.br": true,
+	"yahoo.com.mx": true, "yahoo.com.ar": true, "yahoo.com.sg": true, "yahoo.com.ph": true, "yahoo.gr": true, "yahoo.se": true,
+	"outlook.de": true, "outlook.fr": true, "outlook.it": true, "outlook.es": true, "outlook.jp": true, "outlook.be": true,
+	"live.co.uk": true, "live.fr": true, "live.de": true, "live.it": true, "live.nl": true, "live.ca": true, "live.be": true,
+	"live.se": true, "live.dk": true, "live.no": true, "live.at": true, "live.ie": true, "live.com.au": true, "live.com.mx": true,
+	"gmx.at": true, "gmx.ch": true, "gmx.fr": true, "gmx.us": true, "aol.de": true, "aol.fr": true, "aol.co.uk": true,
+	"mail.ru": true, "mail.de": true, "ymail.com": true, "rocketmail.com": true, "msn.de": true, "me.de": true,
+}
+
+var emailLocal = regexp.MustCompile(`^[a-z0-9!#$%&'*+/=?^_{|}~\-]+(\.[a-z0-9!#$%&'*+/=?^_{|}~\-]+)*$`)
+var emailDomain = regexp.MustCompile(`^([a-z0-9]([a-z0-9\-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+
+// emailAddress is an analysed address. Address is what the user wrote, lower-cased;
+// Canonical folds provider aliases, dots and tags so that variants of one mailbox
+// share an identity key.
+type emailAddress struct {
+	Address    string `json:"address"`
+	Canonical  string `json:"canonical,omitempty"`
+	Valid      bool   `json:"valid"`
+	Disposable bool   `json:"disposable,omitempty"`
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+func analyzeEmail(raw string, c RuntimeConfig) emailAddress {
+	e := emailAddress{Address: normalizeEmail(raw)}
+	if a, err := mail.ParseAddress(e.Address); err == nil {
+		e.Address = normalizeEmail(a.Address)
+	}
+	local, domain, ok := strings.Cut(e.Address, "@")
+	if !ok || len(e.Address) > 254 || len(local) > 64 || !emailLocal.MatchString(local) || !emailDomain.MatchString(domain) {
+		return e
+	}
+	e.Valid = true
+	e.Disposable = disposableDomains[domain] || containsString(c.EmailDisposable, domain)
+	e.Suggestion = suggestEmailDomain(local, domain)
+	rule, ok := c.EmailDomainRules[domain]
+	if !ok {
+		rule = builtinEmailRules[domain]
+	}
+	if rule.TagSep != "" {
+		local, _, _ = strings.Cut(local, rule.TagSep)
+	}
+	if rule.IgnoreDots {
+		local = strings.ReplaceAll(local, ".", "")
+	}
+	e.Canonical = local + "@" + ternary(rule.Alias != "", rule.Alias, domain)
+	return e
+}
+
+// suggestEmailDomain proposes the intended address when domain is one or two edits
+// away from a common provider ("gmial.com", "hotmail.con"). Known provider domains
+// are never suggested away from.
+func suggestEmailDomain(local, domain string) string {
+	if containsString(commonEmailDomains, domain) || knownEmailDomains[domain] {
+		return ""
+	}
+	best, bestDist := "", 3
+	for _, d := range commonEmailDomains {
+		limit := ternary(len(d) <= 8, 1, 2)
+		if dist := editDistance(domain, d); dist <= limit && dist < bestDist {
+			best, bestDist = d, dist
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return local + "@" + best
+}
+
+// editDistance is the optimal-string-alignment distance: insertions, deletions,
+// substitutions and swaps of adjacent characters each cost one.
+func editDistance(a, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := ternary(a[i-1] == b[j-1], 0, 1)
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+var (
+	lookupMX  = net.DefaultResolver.LookupMX
+	mxCacheMu sync.Mutex
+	mxCache   = map[string]mxAnswer{}
+)
+
+type mxAnswer struct {
+	receives, known bool
+	until           time.Time
+}
+
+const (
+	mxLookupTimeout = 500 * time.Millisecond
+	mxCacheTTL      = 24 * time.Hour
+	// mxRetryAfter is how long a failed lookup is remembered, so a slow or down
+	// resolver costs a chat turn at most one timeout per domain per period.
+	mxRetryAfter = time.Minute
+)
+
+// domainReceivesMail reports whether domain publishes MX records. known is false when
+// the lookup failed (timeout, resolver error): that says nothing either way about the
+// domain, so callers must not treat it as a domain without mail.
+func domainReceivesMail(ctx context.Context, domain string) (receives, known bool) {
+	now := time.Now()
+	mxCacheMu.Lock()
+	a, cached := mxCache[domain]
+	mxCacheMu.Unlock()
+	if cached && now.Before(a.until) {
+		return a.receives, a.known
+	}
+	ctx, cancel := context.WithTimeout(ctx, mxLookupTimeout)
+	defer cancel()
+	mx, err := lookupMX(ctx, domain)
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil || errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		a = mxAnswer{receives: len(mx) > 0, known: true, until: now.Add(mxCacheTTL)}
+	default:
+		a = mxAnswer{until: now.Add(mxRetryAfter)}
+	}
+	mxCacheMu.Lock()
+	defer mxCacheMu.Unlock()
+	if len(mxCache) >= 10000 {
+		for d, old := range mxCache {
+			if !now.Before(old.until) {
+				delete(mxCache, d)
+			}
+		}
+		if len(mxCache) >= 10000 {
+			clear(mxCache)
+		}
+	}
+	mxCache[domain] = a
+	return a.receives, a.known
+}
+
+// normalizeExtractedEmail checks the extracted email. Invalid addresses and likely
+// typos are not stored: the typo's suggestion is put in front of the chat model so it
+// can ask the user to confirm.
+func normalizeExtractedEmail(ctx context.Context, extracted map[string]any, c RuntimeConfig) {
+	raw := asString(extracted["email"])
+	if strings.TrimSpace(raw) == "" {
+		return
+	}
+	e := analyzeEmail(raw, c)
+	if _, domain, _ := strings.Cut(e.Address, "@"); e.Suggestion != "" {
+		// A domain that receives mail is not a typo. If DNS cannot tell, the suggestion
+		// stands: the user is only asked to confirm, and the address is not marked invalid.
+		if receives, known := domainReceivesMail(ctx, domain); known && receives {
+			e.Suggestion = ""
+		}
+	}
+	extracted["email_raw"], extracted["email_valid"] = raw, e.Valid
+	extracted["email"] = ternary[any](e.Valid && e.Suggestion == "", e.Address, nil)
+	if e.Canonical != "" {
+		extracted["email_canonical"] = e.Canonical
+	}
+	if e.Disposable {
+		extracted["email_disposable"] = true
+	}
+	if e.Suggestion != "" {
+		extracted["email_suggestion"] = e.Suggestion
+		extracted["needs_verification"] = true
+	}
+}
+
+// extractionNote tells the chat model about extracted values it should confirm with
+// the user before relying on them.
+func extractionNote(extracted map[string]any) string {
+	notes := []string{}
+	if s := asString(extracted["email_suggestion"]); s != "" {
+		notes = append(notes, fmt.Sprintf("The email the user gave (%s) looks like a typo of %s. Ask them to confirm which is correct.", asString(extracted["email_raw"]), s))
+	} else if extracted["email_valid"] == false {
+		notes = append(notes, fmt.Sprintf("The email the user gave (%s) is not a valid address. Ask them to check it.", asString(extracted["email_raw"])))
+	}
+	if r, ok := extracted["address_status"].(addressResult); ok && r.note() != "" {
+		notes = append(notes, r.note())
+	}
+	if note := workflowNote(extracted); note != "" {
+		notes = append(notes, note)
+	}
+	if extracted["phone_valid"] == false && extracted["phone"] == nil {
+		notes = append(notes, fmt.Sprintf("The phone number the user gave (%s) does not look complete. Ask them for it with the country code.", asString(extracted["phone_raw"])))
+	}
+	return strings.Join(notes, "\n")
+}
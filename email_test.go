@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAnalyzeEmail(t *testing.T) {
+	c := RuntimeConfig{EmailDomainRules: map[string]emailRule{"corp.example": {TagSep: "-", Alias: "example.com"}}, EmailDisposable: []string{"junk.example"}}
+	cases := []struct {
+		raw  string
+		want emailAddress
+	}{
+		{"John.Doe+shop@Gmail.com", emailAddress{Address: "john.doe+shop@gmail.com", Canonical: "johndoe@gmail.com", Valid: true}},
+		{"jane.doe@googlemail.com", emailAddress{Address: "jane.doe@googlemail.com", Canonical: "janedoe@gmail.com", Valid: true}},
+		{"Jane <jane+x@outlook.com>", emailAddress{Address: "jane+x@outlook.com", Canonical: "jane@outlook.com", Valid: true}},
+		{"bob-news@corp.example", emailAddress{Address: "bob-news@corp.example", Canonical: "bob@example.com", Valid: true}},
+		{"temp@mailinator.com", emailAddress{Address: "temp@mailinator.com", Canonical: "temp@mailinator.com", Valid: true, Disposable: true}},
+		{"temp@junk.example", emailAddress{Address: "temp@junk.example", Canonical: "temp@junk.example", Valid: true, Disposable: true}},
+		{"jo@gmial.com", emailAddress{Address: "jo@gmial.com", Canonical: "jo@gmial.com", Valid: true, Suggestion: "jo@gmail.com"}},
+		{"jo@hotmail.con", emailAddress{Address: "jo@hotmail.con", Canonical: "jo@hotmail.con", Valid: true, Suggestion: "jo@hotmail.com"}},
+		{"jo@hotmail.de", emailAddress{Address: "jo@hotmail.de", Canonical: "jo@hotmail.de", Valid: true}},
+		{"jo@yahoo.co.in", emailAddress{Address: "jo@yahoo.co.in", Canonical: "jo@yahoo.co.in", Valid: true}},
+		{"jo..x@example.com", emailAddress{Address: "jo..x@example.com"}},
+		{"not an email", emailAddress{Address: "not an email"}},
+	}
+	for _, tc := range cases {
+		if got := analyzeEmail(tc.raw, c); got != tc.want {
+			t.Errorf("analyzeEmail(%q) = %+v, want %+v", tc.raw, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeExtractedEmailMX(t *testing.T) {
+	prev := lookupMX
+	defer func() { lookupMX = prev; clear(mxCache) }()
+	lookupMX = func(_ context.Context, name string) ([]*net.MX, error) {
+		if name == "gmial.com" {
+			return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		return []*net.MX{{Host: "mx." + name, Pref: 10}}, nil
+	}
+	clear(mxCache)
+	for raw, suggested := range map[string]bool{"jo@gmial.com": true, "jo@gmai.com": false} {
+		ex := map[string]any{"email": raw}
+		normalizeExtractedEmail(context.Background(), ex, RuntimeConfig{})
+		if (ex["email_suggestion"] != nil) != suggested || (ex["email"] == nil) != suggested {
+			t.Errorf("%s: email %v, suggestion %v; want suggestion %v", raw, ex["email"], ex["email_suggestion"], suggested)
+		}
+	}
+}
+
+func TestDomainReceivesMailLookupFailure(t *testing.T) {
+	prev := lookupMX
+	defer func() { lookupMX = prev; clear(mxCache) }()
+	clear(mxCache)
+	lookups := 0
+	lookupMX = func(ctx context.Context, name string) ([]*net.MX, error) {
+		lookups++
+		<-ctx.Done()
+		return nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true}
+	}
+	t0 := time.Now()
+	for range 2 {
+		if receives, known := domainReceivesMail(context.Background(), "gmial.com"); receives || known {
+			t.Errorf("failed lookup = %v, %v; want unknown", receives, known)
+		}
+	}
+	if d := time.Since(t0); d > 2*mxLookupTimeout {
+		t.Errorf("two lookups took %v, want one timeout", d)
+	}
+	if lookups != 1 {
+		t.Errorf("resolver asked %d times, want the failure remembered", lookups)
+	}
+	ex := map[string]any{"email": "jo@gmial.com"}
+	normalizeExtractedEmail(context.Background(), ex, RuntimeConfig{})
+	if ex["email_suggestion"] == nil || ex["email_valid"] != true {
+		t.Errorf("unknown domain: suggestion %v, valid %v; want the suggestion kept and the address valid", ex["email_suggestion"], ex["email_valid"])
+	}
+}
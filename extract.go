@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Extraction runs in two passes. ruleExtract finds what patterns can find reliably
+// (emails, phone numbers, "#12345"-style order ids, postal codes, intent keywords)
+// for free; the LLM extractor then runs only when the message may hold something the
+// rules cannot see, and its output is merged over the rule results. When the LLM call
+// fails the rule results stand in for it.
+
+var (
+	ruleEmail   = regexp.MustCompile(`(?i)\b[a-z0-9._%+\-]+@[a-z0-9\-]+(?:\.[a-z0-9\-]+)*\.[a-z]{2,}\b`)
+	ruleOrderID = regexp.MustCompile(`(?i)(?:#\s?|\border(?:\s+(?:number|no\.?|id|num))?(?:\s+is)?\s*[:#]?\s*)([a-z]{0,4}-?\d{3,12})\b`)
+	rulePhone   = regexp.MustCompile(`\+?\(?\d[\d\s\-.()]{5,}\d`)
+	ruleDate    = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$|^\d{1,2}[./\-]\d{1,2}[./\-]\d{2,4}$`)
+
+	// ruleAfterOrder marks a number as part of an order reference, not a phone number.
+	ruleAfterOrder = regexp.MustCompile(`(?i)\border\b[^.!?\d]{0,20}$`)
+
+	// Postal codes: UK and Canadian formats are distinctive enough on their own; a US
+	// ZIP needs a "zip"/"postal code" label or a preceding state abbreviation.
+	rulePostalGB = regexp.MustCompile(`\b([A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2})\b`)
+	rulePostalCA = regexp.MustCompile(`\b([A-Z]\d[A-Z] ?\d[A-Z]\d)\b`)
+	rulePostalUS = regexp.MustCompile(`(?i)(?:\b(?:zip|zip code|postal code|postcode)\s*:?\s*|,\s*[A-Z]{2}\s+)(\d{5}(?:-\d{4})?)\b`)
+
+	// ruleCues are words that suggest a name or address the rules cannot extract.
+	ruleCues = regexp.MustCompile(`(?i)\b(name|i'm|i am|this is|call me|email|e-mail|phone|mobile|cell|number|address|street|st\.|ave|avenue|road|rd\.|lane|apt|suite|ship to|deliver to|live in|city|zip|postcode)\b`)
+)
+
+// intentKeywords are checked in order; the first intent with a match wins, so the
+// more specific requests come first.
+var intentKeywords = []struct {
+	intent string
+	re     *regexp.Regexp
+}{
+	{"handoff_human", regexp.MustCompile(`(?i)\b(human|real person|agent|representative|speak to (someone|somebody)|talk to (someone|somebody))\b`)},
+	{"returns_refunds", regexp.MustCompile(`(?i)\b(return|returns|returning|refund|refunds|refunded|exchange|money back|send (it )?back)\b`)},
+	{"shipping_delivery", regexp.MustCompile(`(?i)\b(shipping|shipped|ship|delivery|deliver|delivered|tracking|track|arrive|arrived|package|parcel|courier)\b`)},
+	{"order_support", regexp.MustCompile(`(?i)(\border\b|\borders\b|\bcancel\b|\bwrong item\b|\bmissing item\b|#\s?\d)`)},
+	{"account_support", regexp.MustCompile(`(?i)\b(account|password|log ?in|sign ?in|sign ?up|unsubscribe|newsletter)\b`)},
+	{"product_or_content", regexp.MustCompile(`(?i)\b(price|cost|size|sizes|sizing|colou?rs?|in stock|stock|product|products|recommend|material|fit|available)\b`)},
+}
+
+var extractorLLMSkipped = newCounterVec("chatbot_extractor_llm_skipped_total", "Turns whose extraction was answered by the rules alone.")
+
+func emptyExtraction() map[string]any {
+	return map[string]any{"name": nil, "email": nil, "phone": nil, "order_id": nil, "address": nil, "address_components": map[string]any{"line1": nil, "line2": nil, "city": nil, "state": nil, "postal_code": nil, "country": nil}, "intent": "other", "confidence": 0, "needs_verification": false, "notes": nil}
+}
+
+// ruleExtract returns the fields the patterns find in text, in the extractor's schema.
+func ruleExtract(text string) map[string]any {
+	ex := emptyExtraction()
+	rest := text
+	if m := ruleEmail.FindString(rest); m != "" {
+		ex["email"] = normalizeEmail(m)
+		rest = strings.Replace(rest, m, " ", 1)
+	}
+	if m := ruleOrderID.FindStringSubmatch(rest); m != nil {
+		ex["order_id"] = strings.ToUpper(m[1])
+		rest = strings.Replace(rest, m[0], " ", 1)
+	}
+	comps := mapOf(ex["address_components"])
+	for _, p := range []struct {
+		re      *regexp.Regexp
+		country string
+	}{{rulePostalUS, "US"}, {rulePostalCA, "CA"}, {rulePostalGB, "GB"}} {
+		if m := p.re.FindStringSubmatch(rest); m != nil {
+			comps["postal_code"], comps["country"] = m[1], p.country
+			rest = strings.Replace(rest, m[1], " ", 1)
+			break
+		}
+	}
+	ex["address_components"] = comps
+	for _, loc := range rulePhone.FindAllStringIndex(rest, -1) {
+		m := strings.TrimSpace(rest[loc[0]:loc[1]])
+		if n := len(onlyDigits(m)); n >= 7 && n <= 15 && !ruleDate.MatchString(m) && !ruleAfterOrder.MatchString(rest[:loc[0]]) {
+			ex["phone"] = m
+			break
+		}
+	}
+	for _, k := range intentKeywords {
+		if k.re.MatchString(text) {
+			ex["intent"] = k.intent
+			break
+		}
+	}
+	fc := map[string]any{}
+	for _, f := range []string{"email", "phone", "order_id"} {
+		if ex[f] != nil {
+			fc[f] = ruleConfidence
+		}
+	}
+	ex["field_confidence"] = fc
+	if len(fc) > 0 || comps["postal_code"] != nil {
+		ex["confidence"] = ruleConfidence
+	}
+	ex["notes"] = "rules"
+	return ex
+}
+
+// needsLLMExtraction reports whether the message may contain fields the rules cannot
+// extract. Messages without digits, "@" or name/address cue words are answered by the
+// rules alone.
+func needsLLMExtraction(text string) bool {
+	return strings.ContainsAny(text, "0123456789@") || ruleCues.MatchString(text)
+}
+
+// ruleConfidence is the confidence of a field found by the patterns.
+const ruleConfidence = 85
+
+// mergeExtracted lays the LLM's non-null fields over the rule results; the rules fill
+// whatever the model missed. Confidence is kept per field in field_confidence: a field
+// the rules found keeps their score unless the model read it differently, and the
+// model's score covers the rest, so a pattern hit never vouches for other fields.
+func mergeExtracted(rules, llm map[string]any) map[string]any {
+	out := merge(nil, rules)
+	for k, v := range llm {
+		switch k {
+		case "address_components":
+			comps := mapOf(rules[k])
+			for ck, cv := range mapOf(v) {
+				if cv != nil && asString(cv) != "" {
+					comps[ck] = cv
+				}
+			}
+			out[k] = comps
+		case "intent":
+			if s := asString(v); s != "" && s != "other" {
+				out[k] = s
+			}
+		case "confidence":
+			out[k] = toInt(v)
+		default:
+			if v != nil && (asString(v) != "" || !isString(v)) {
+				out[k] = v
+			}
+		}
+	}
+	conf, fc := toInt(llm["confidence"]), mapOf(rules["field_confidence"])
+	for _, f := range []string{"name", "email", "phone", "order_id"} {
+		switch lv, rv := asString(llm[f]), asString(rules[f]); {
+		case lv == "":
+		case sameFieldValue(f, lv, rv):
+			fc[f] = max(toInt(fc[f]), conf)
+		default:
+			fc[f] = conf
+		}
+	}
+	out["field_confidence"] = fc
+	out["notes"] = strings.TrimSpace("rules+llm " + asString(llm["notes"]))
+	return out
+}
+
+func sameFieldValue(field, a, b string) bool {
+	switch field {
+	case "email":
+		return normalizeEmail(a) == normalizeEmail(b)
+	case "phone":
+		return onlyDigits(a) == onlyDigits(b)
+	}
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
+
+// fieldConfidence is the confidence of one extracted field.
+func fieldConfidence(extracted map[string]any, field string) int {
+	if v, ok := mapOf(extracted["field_confidence"])[field]; ok {
+		return toInt(v)
+	}
+	return toInt(extracted["confidence"])
+}
+
+func isString(v any) bool { _, ok := v.(string); return ok }
+
+// extractFields runs the rule pass and, when needed, the LLM extractor, whose schema
+// carries the fields of the workflow the conversation is in. llm reports whether the
+// model was called; err is its failure, in which case the rule results are returned.
+func extractFields(ctx context.Context, client *http.Client, key, text string, convMeta map[string]any) (ex map[string]any, usage tokenUsage, llm bool, err error) {
+	rules := ruleExtract(text)
+	wf := activeWorkflow(asString(rules["intent"]), convMeta)
+	missing, asked := []string{}, ""
+	if wf != nil {
+		state := mapOf(convMeta["workflow"])
+		if asString(state["id"]) == wf.ID {
+			missing = missingSlots(ctx, wf, mapOf(state["slots"]))
+			asked = first(missing)
+		} else {
+			missing = missingSlots(ctx, wf, nil)
+		}
+	}
+	if !needsLLMExtraction(text) && len(missing) == 0 {
+		extractorLLMSkipped.Inc()
+		return rules, usage, false, nil
+	}
+	out, usage, err := aiExtractFields(ctx, client, key, text, wf, asked)
+	if err != nil {
+		rules["notes"] = "rules only; LLM extractor failed"
+		return rules, usage, true, err
+	}
+	return mergeExtracted(rules, out), usage, true, nil
+}
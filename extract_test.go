@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestRuleExtract(t *testing.T) {
+	cases := []struct {
+		text   string
+		want   map[string]any
+		intent string
+	}{
+		{"my email is John.Doe@Example.com", map[string]any{"email": "john.doe@example.com", "phone": nil, "order_id": nil}, "other"},
+		{"where is order #A-12345?", map[string]any{"order_id": "A-12345", "phone": nil}, "order_support"},
+		{"has my parcel shipped?", map[string]any{"order_id": nil}, "shipping_delivery"},
+		{"my order is 1234", map[string]any{"order_id": "1234", "phone": nil}, "order_support"},
+		{"order number is 55667788, call me on +44 7700 900123", map[string]any{"order_id": "55667788", "phone": "+44 7700 900123"}, "order_support"},
+		{"delivered on 2024-03-14", map[string]any{"phone": nil}, "shipping_delivery"},
+		{"I want a refund", map[string]any{"email": nil, "phone": nil, "order_id": nil}, "returns_refunds"},
+		{"can I speak to a human about my order", map[string]any{}, "handoff_human"},
+	}
+	for _, tc := range cases {
+		ex := ruleExtract(tc.text)
+		for k, v := range tc.want {
+			if ex[k] != v {
+				t.Errorf("ruleExtract(%q)[%s] = %v, want %v", tc.text, k, ex[k], v)
+			}
+		}
+		if ex["intent"] != tc.intent {
+			t.Errorf("ruleExtract(%q) intent = %v, want %s", tc.text, ex["intent"], tc.intent)
+		}
+	}
+
+	ex := ruleExtract("ship to Springfield, IL 62704")
+	if c := mapOf(ex["address_components"]); c["postal_code"] != "62704" || c["country"] != "US" {
+		t.Errorf("US ZIP after a state: got %v", c)
+	}
+	ex = ruleExtract("my postcode is SW1A 2AA")
+	if c := mapOf(ex["address_components"]); c["postal_code"] != "SW1A 2AA" || c["country"] != "GB" {
+		t.Errorf("UK postcode: got %v", c)
+	}
+}
+
+func TestMergeExtractedFieldConfidence(t *testing.T) {
+	rules := ruleExtract("reach me at jane@example.com")
+	llm := map[string]any{"name": "Jane Roe", "email": "Jane@Example.com", "phone": "555 0100", "intent": "other", "confidence": 40}
+	ex := mergeExtracted(rules, llm)
+	for f, want := range map[string]int{"email": ruleConfidence, "name": 40, "phone": 40} {
+		if got := fieldConfidence(ex, f); got != want {
+			t.Errorf("confidence of %s = %d, want %d", f, got, want)
+		}
+	}
+	if ex["name"] != "Jane Roe" {
+		t.Errorf("name = %v, want the extractor's", ex["name"])
+	}
+
+	// A field the model read differently gets the model's confidence, not the rules'.
+	ex = mergeExtracted(ruleExtract("order #1234"), map[string]any{"order_id": "9999", "confidence": 30})
+	if ex["order_id"] != "9999" || fieldConfidence(ex, "order_id") != 30 {
+		t.Errorf("order_id = %v at %d, want 9999 at 30", ex["order_id"], fieldConfidence(ex, "order_id"))
+	}
+}
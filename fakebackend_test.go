@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeBackend is an in-memory stand-in for Supabase PostgREST and the OpenAI Responses
+// API, used by the tests and BenchmarkChatTurn. It implements only what this server
+// sends: eq./in./gte./lt. and and=() filters, order, limit, offset, on_conflict upserts, bulk inserts, deletes and the Prefer
+// return modes. Every request sleeps for a fixed per-upstream latency.
+type fakeBackend struct {
+	SupabaseLatency time.Duration
+	OpenAILatency   time.Duration
+	// Reply, when set, produces the chat model's text for a given request input.
+	Reply func(input []any) string
+	// Extract, when set, produces the extractor's JSON text; the default is an empty
+	// extraction.
+	Extract func(input []any) string
+	// Fail, when set, answers a Supabase request with the status it returns instead of
+	// serving it; 0 serves it.
+	Fail func(r *http.Request) int
+
+	mu     sync.Mutex
+	tables map[string][]map[string]any
+	seq    int64
+	calls  atomic.Int64
+}
+
+// fakeUniqueKeys mirrors the unique constraints of the Supabase schema.
+var fakeUniqueKeys = map[string][]string{
+	"app_users":      {"tenant_id", "anonymous_id"},
+	"user_sessions":  {"tenant_id", "session_id"},
+	"identity_keys":  {"tenant_id", "user_id", "key_type", "key_value"},
+	"user_addresses": {"tenant_id", "user_id", "fingerprint"},
+}
+
+func newFakeBackend(sbLatency, aiLatency time.Duration) *fakeBackend {
+	return &fakeBackend{SupabaseLatency: sbLatency, OpenAILatency: aiLatency, tables: map[string][]map[string]any{}}
+}
+
+func (f *fakeBackend) Calls() int64 { return f.calls.Load() }
+
+func (f *fakeBackend) Rows(table string) []map[string]any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]map[string]any(nil), f.tables[table]...)
+}
+
+func (f *fakeBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.calls.Add(1)
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/rest/v1/"):
+		time.Sleep(f.SupabaseLatency)
+		f.serveREST(w, r, strings.TrimPrefix(r.URL.Path, "/rest/v1/"))
+	case r.URL.Path == "/v1/responses":
+		time.Sleep(f.OpenAILatency)
+		f.serveResponses(w, r)
+	case r.URL.Path == "/v1/moderations":
+		time.Sleep(f.OpenAILatency)
+		f.serveModerations(w, r)
+	case r.URL.Path == "/v1/models":
+		data := []any{}
+		for _, id := range []string{"gpt-5-mini", "gpt-4o-mini", "gpt-4o-mini-2024-07-18", "gpt-4o-audio-preview", "text-embedding-3-small", "omni-moderation-latest"} {
+			data = append(data, map[string]any{"id": id, "object": "model"})
+		}
+		writeJSON(w, 200, map[string]any{"data": data})
+	default:
+		writeJSON(w, 404, map[string]any{"message": "not found"})
+	}
+}
+
+func (f *fakeBackend) serveREST(w http.ResponseWriter, r *http.Request, table string) {
+	if f.Fail != nil {
+		if status := f.Fail(r); status != 0 {
+			writeJSON(w, status, map[string]any{"message": "injected failure"})
+			return
+		}
+	}
+	q := r.URL.Query()
+	prefer := r.Header.Get("Prefer")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		rows := f.filter(table, q)
+		if ord := q.Get("order"); ord != "" {
+			col, dir, _ := strings.Cut(ord, ".")
+			sort.SliceStable(rows, func(i, j int) bool {
+				a, b := fmt.Sprint(rows[i][col]), fmt.Sprint(rows[j][col])
+				return ternary(dir == "desc", a > b, a < b)
+			})
+		}
+		if n, err := strconv.Atoi(q.Get("offset")); err == nil {
+			rows = rows[min(n, len(rows)):]
+		}
+		if n, err := strconv.Atoi(q.Get("limit")); err == nil && n < len(rows) {
+			rows = rows[:n]
+		}
+		writeJSON(w, 200, rows)
+	case http.MethodPost:
+		body, _ := io.ReadAll(r.Body)
+		var batch []map[string]any
+		if json.Unmarshal(body, &batch) != nil {
+			var one map[string]any
+			if err := json.Unmarshal(body, &one); err != nil {
+				writeJSON(w, 400, map[string]any{"message": err.Error()})
+				return
+			}
+			batch = []map[string]any{one}
+		}
+		upsert := strings.Contains(prefer, "resolution=merge-duplicates")
+		out := []map[string]any{}
+		for _, row := range batch {
+			if existing := f.conflict(table, row); existing != nil {
+				if strings.Contains(prefer, "resolution=ignore-duplicates") {
+					continue
+				}
+				if !upsert {
+					writeJSON(w, 409, map[string]any{"code": "23505", "message": "duplicate key value violates unique constraint"})
+					return
+				}
+				for k, v := range row {
+					existing[k] = v
+				}
+				out = append(out, existing)
+				continue
+			}
+			f.seq++
+			stored := merge(map[string]any{"id": fmt.Sprintf("fake-%d", f.seq), "created_at": time.Now().UTC().Format(time.RFC3339Nano)}, row)
+			f.tables[table] = append(f.tables[table], stored)
+			out = append(out, stored)
+		}
+		if strings.Contains(prefer, "return=representation") {
+			writeJSON(w, 201, out)
+			return
+		}
+		w.WriteHeader(201)
+	case http.MethodPatch:
+		var patch map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&patch)
+		rows := f.filter(table, q)
+		for _, row := range rows {
+			for k, v := range patch {
+				row[k] = v
+			}
+		}
+		if strings.Contains(prefer, "return=representation") {
+			writeJSON(w, 200, rows)
+			return
+		}
+		w.WriteHeader(204)
+	case http.MethodDelete:
+		kept := []map[string]any{}
+		for _, row := range f.tables[table] {
+			if !fakeRowMatches(row, q) {
+				kept = append(kept, row)
+			}
+		}
+		f.tables[table] = kept
+		w.WriteHeader(204)
+	default:
+		writeJSON(w, 405, map[string]any{"message": "method not allowed"})
+	}
+}
+
+// filter returns the stored rows of table matching every column filter in q.
+func (f *fakeBackend) filter(table string, q map[string][]string) []map[string]any {
+	out := []map[string]any{}
+	for _, row := range f.tables[table] {
+		if fakeRowMatches(row, q) {
+			out = append(out, row)
+		}
+	}
+	return out
+}
+
+func fakeRowMatches(row map[string]any, q map[string][]string) bool {
+	ok := true
+	for col, vals := range q {
+		switch {
+		case col == "select" || col == "order" || col == "limit" || col == "offset" || col == "on_conflict" || len(vals) == 0:
+		case col == "and":
+			for _, cond := range strings.Split(strings.Trim(vals[0], "()"), ",") {
+				c, spec, _ := strings.Cut(cond, ".")
+				ok = ok && fakeMatch(row[c], spec)
+			}
+		default:
+			ok = ok && fakeMatch(row[col], vals[0])
+		}
+	}
+	return ok
+}
+
+func fakeMatch(v any, spec string) bool {
+	op, want, _ := strings.Cut(spec, ".")
+	got := fmt.Sprint(v)
+	switch op {
+	case "eq":
+		return got == want
+	case "in":
+		return containsString(splitCSV(strings.Trim(want, "()")), got)
+	case "gte":
+		return fakeCompare(got, want) >= 0
+	case "lt":
+		return fakeCompare(got, want) < 0
+	}
+	return true
+}
+
+// fakeCompare orders timestamps as times, like Postgres, and everything else as text.
+func fakeCompare(a, b string) int {
+	ta, errA := time.Parse(time.RFC3339, a)
+	tb, errB := time.Parse(time.RFC3339, b)
+	if errA == nil && errB == nil {
+		return ta.Compare(tb)
+	}
+	return strings.Compare(a, b)
+}
+
+func (f *fakeBackend) conflict(table string, row map[string]any) map[string]any {
+	cols := fakeUniqueKeys[table]
+	if len(cols) == 0 {
+		return nil
+	}
+	for _, existing := range f.tables[table] {
+		match := true
+		for _, c := range cols {
+			if fmt.Sprint(existing[c]) != fmt.Sprint(row[c]) {
+				match = false
+				break
+			}
+		}
+		if match {
+			return existing
+		}
+	}
+	return nil
+}
+
+func (f *fakeBackend) serveResponses(w http.ResponseWriter, r *http.Request) {
+	var payload map[string]any
+	_ = json.NewDecoder(r.Body).Decode(&payload)
+	input, _ := payload["input"].([]any)
+	format, _ := payload["text"].(map[string]any)
+	fmtType := ""
+	if m, ok := format["format"].(map[string]any); ok {
+		fmtType = asString(m["type"])
+	}
+	var text string
+	switch {
+	case fmtType == "json_schema" && f.Extract != nil:
+		text = f.Extract(input)
+	case fmtType == "json_schema":
+		j, _ := json.Marshal(emptyExtraction())
+		text = string(j)
+	case f.Reply != nil:
+		text = f.Reply(input)
+	default:
+		last := ""
+		if len(input) > 0 {
+			if m, ok := input[len(input)-1].(map[string]any); ok {
+				last = asString(m["content"])
+			}
+		}
+		text = "Thanks! You said: " + last
+	}
+	writeJSON(w, 200, map[string]any{
+		"id":          fmt.Sprintf("resp_fake_%d", time.Now().UnixNano()),
+		"model":       payload["model"],
+		"output_text": text,
+		"output":      []any{map[string]any{"type": "message", "content": []any{map[string]any{"type": "output_text", "text": text}}}},
+		"usage":       map[string]any{"input_tokens": 100, "output_tokens": 20, "total_tokens": 120, "input_tokens_details": map[string]any{"cached_tokens": 0}},
+	})
+}
+
+// serveModerations flags what the local classifier flags, under OpenAI's category names.
+func (f *fakeBackend) serveModerations(w http.ResponseWriter, r *http.Request) {
+	var payload map[string]any
+	_ = json.NewDecoder(r.Body).Decode(&payload)
+	cats, _ := localModeration{}.classify(r.Context(), nil, "", asString(payload["input"]))
+	flags := map[string]bool{}
+	for name, c := range openAIModerationCategories {
+		if !strings.Contains(name, "/") || c == "sexual_minors" {
+			flags[name] = containsString(cats, c)
+		}
+	}
+	writeJSON(w, 200, map[string]any{"results": []any{map[string]any{"flagged": len(cats) > 0, "categories": flags}}})
+}
+
+// useFakeBackend points Supabase and OpenAI at fake for the rest of the test.
+func useFakeBackend(tb testing.TB, fake *fakeBackend) {
+	srv := httptest.NewServer(fake)
+	prev, prevLogger := getConfig(), logger
+	tb.Cleanup(func() {
+		waitBackground()
+		srv.Close()
+		setConfig(prev)
+		logger = prevLogger
+	})
+	logger = newLogger("text", "error")
+	updateConfig(func(c *RuntimeConfig) {
+		c.SupabaseURL, c.SupabaseServiceRole = srv.URL, "test"
+		c.OpenAIAPIKey, c.OpenAIBaseURL = "test", srv.URL
+		c.LogLevel = "error"
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Replies are checked before they reach the user. Order numbers, tracking numbers,
+// amounts and dates in a reply must appear in what the turn knows (the user's
+// messages, the extracted fields and tool results), and a reply may ask at most one
+// question. A failing reply is regenerated once with the problems pointed out; if
+// that also fails the user gets a safe template instead.
+
+type guardrailViolation struct {
+	Rule  string `json:"rule"`
+	Value string `json:"value,omitempty"`
+}
+
+type guardrailResult struct {
+	Violations []guardrailViolation `json:"violations,omitempty"`
+	Action     string               `json:"action,omitempty"` // regenerated or fallback
+	DraftModel string               `json:"draft_model,omitempty"`
+	Draft      string               `json:"-"`
+	Attempts   []modelAttempt       `json:"-"`
+	Usage      tokenUsage           `json:"-"`
+}
+
+// guardrailFallbackModel is reported as the model of a reply replaced by the fallback
+// template; the model that wrote the rejected draft is in DraftModel.
+const guardrailFallbackModel = "guardrail_fallback"
+
+var guardrailFallbackReply = "I'm sorry, I can't confirm those details right now. I can pass your request to our support team so they can check it for you."
+
+var (
+	guardTracking = regexp.MustCompile(`(?i)\btracking(?:\s+(?:number|no\.?|code|id))?\s*(?:is|:|#)?\s*([A-Z0-9]{8,30})\b|\b(1Z[0-9A-Z]{16})\b|\b([A-Z]{2}\d{9}[A-Z]{2})\b`)
+	guardAmount   = regexp.MustCompile(`(?i)[$€£]\s?(\d[\d,]*(?:\.\d{1,2})?)|\b(\d[\d,]*(?:\.\d{1,2})?)\s?(?:usd|eur|gbp|cad|aud|dollars|euros|pounds)\b`)
+	guardDateISO  = regexp.MustCompile(`\b\d{4}-(\d{2})-(\d{2})\b`)
+	guardDateNum  = regexp.MustCompile(`\b(\d{1,2})/(\d{1,2})(?:/\d{2,4})?\b`)
+	guardDateMD   = regexp.MustCompile(`(?i)\b(jan|feb|mar|apr|may|jun|jul|aug|sep|sept|oct|nov|dec)[a-z]*\.?\s+(\d{1,2})(?:st|nd|rd|th)?\b`)
+	guardDateDM   = regexp.MustCompile(`(?i)\b(\d{1,2})(?:st|nd|rd|th)?\s+(?:of\s+)?(jan|feb|mar|apr|may|jun|jul|aug|sep|sept|oct|nov|dec)[a-z]*\b`)
+	guardURL      = regexp.MustCompile(`https?://\S+`)
+	guardQuestion = regexp.MustCompile(`\?+`)
+)
+
+// guardAmountField finds money values in tool output, where they are JSON fields such
+// as "total_price": "1299.00" rather than written with a currency.
+var guardAmountField = regexp.MustCompile(`(?i)"[a-z_]*(?:price|amount|total|cost|refund|balance)[a-z_]*"\s*:\s*"?(\d[\d,]*(?:\.\d+)?)`)
+
+var guardrailViolations = newCounterVec("chatbot_guardrail_violations_total", "Replies that failed an output guardrail, by rule.", "rule")
+
+var monthNumbers = map[string]int{"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "sept": 9, "oct": 10, "nov": 11, "dec": 12}
+
+// groundingText is what a reply may state facts from: the user's messages in the
+// conversation, the instructions given to the chat model (system prompt, tenant
+// policy and notes) and this turn's tool output.
+func groundingText(userMessages []string, instructions string, toolOutput ...any) string {
+	parts := append([]string{}, userMessages...)
+	parts = append(parts, instructions)
+	for _, o := range toolOutput {
+		b, _ := json.Marshal(o)
+		parts = append(parts, string(b))
+	}
+	return strings.Join(parts, "\n")
+}
+
+// checkReply returns the guardrails reply breaks given what grounding supports.
+func checkReply(reply, grounding string) []guardrailViolation {
+	out := []guardrailViolation{}
+	upper := strings.ToUpper(grounding)
+	add := func(rule, v string) {
+		for _, o := range out {
+			if o.Rule == rule && o.Value == v {
+				return
+			}
+		}
+		out = append(out, guardrailViolation{rule, v})
+	}
+	for _, m := range ruleOrderID.FindAllStringSubmatch(reply, -1) {
+		if id := strings.ToUpper(m[1]); !strings.Contains(upper, id) && !strings.Contains(upper, strings.ReplaceAll(id, "-", "")) {
+			add("unverified_order_number", id)
+		}
+	}
+	for _, m := range guardTracking.FindAllStringSubmatch(reply, -1) {
+		if t := strings.ToUpper(m[1] + m[2] + m[3]); strings.ContainsAny(t, "0123456789") && !strings.Contains(upper, t) {
+			add("unverified_tracking_number", t)
+		}
+	}
+	// Amounts must match an amount in grounding, not just any number: "30 days" does
+	// not make "$30" a fact.
+	known := map[string]bool{}
+	for _, m := range guardAmount.FindAllStringSubmatch(grounding, -1) {
+		known[normalizeAmount(m[1]+m[2])] = true
+	}
+	for _, m := range guardAmountField.FindAllStringSubmatch(grounding, -1) {
+		known[normalizeAmount(m[1])] = true
+	}
+	for _, m := range guardAmount.FindAllStringSubmatch(reply, -1) {
+		if a := normalizeAmount(m[1] + m[2]); !known[a] {
+			add("unverified_amount", strings.TrimSpace(m[0]))
+		}
+	}
+	knownDates := map[string]bool{}
+	for _, d := range datesIn(grounding) {
+		knownDates[d] = true
+	}
+	for _, d := range datesIn(reply) {
+		if !knownDates[d] {
+			add("unverified_date", d)
+		}
+	}
+	if n := len(guardQuestion.FindAllString(guardURL.ReplaceAllString(reply, ""), -1)); n > 1 {
+		add("too_many_questions", strconv.Itoa(n))
+	}
+	return out
+}
+
+// normalizeAmount makes "1,299.00", "1299" and "1299.0" compare equal.
+func normalizeAmount(s string) string {
+	s = strings.ReplaceAll(strings.TrimSpace(s), ",", "")
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
+
+// datesIn returns the month and day ("03-14") of every date written in text.
+// Slashed dates are read month first.
+func datesIn(text string) []string {
+	out := []string{}
+	add := func(month, day int) {
+		if month >= 1 && month <= 12 && day >= 1 && day <= 31 {
+			out = append(out, fmt.Sprintf("%02d-%02d", month, day))
+		}
+	}
+	for _, m := range guardDateISO.FindAllStringSubmatch(text, -1) {
+		add(atoi(m[1]), atoi(m[2]))
+	}
+	for _, m := range guardDateNum.FindAllStringSubmatch(text, -1) {
+		add(atoi(m[1]), atoi(m[2]))
+	}
+	for _, m := range guardDateMD.FindAllStringSubmatch(text, -1) {
+		add(monthNumbers[strings.ToLower(m[1])], atoi(m[2]))
+	}
+	for _, m := range guardDateDM.FindAllStringSubmatch(text, -1) {
+		add(monthNumbers[strings.ToLower(m[2])], atoi(m[1]))
+	}
+	return out
+}
+
+func atoi(s string) int { n, _ := strconv.Atoi(s); return n }
+
+func guardrailFeedback(vs []guardrailViolation) string {
+	lines := []string{"Your previous reply was not sent because it broke these rules:"}
+	for _, v := range vs {
+		switch v.Rule {
+		case "too_many_questions":
+			lines = append(lines, "- It asked more than one question. Ask at most one.")
+		default:
+			lines = append(lines, fmt.Sprintf("- It stated %s (%s), which is not in the data you were given. Only state order numbers, tracking numbers, amounts and dates the user or the tools provided.", strings.ReplaceAll(strings.TrimPrefix(v.Rule, "unverified_"), "_", " "), v.Value))
+		}
+	}
+	return strings.Join(lines, "\n") + "\nWrite the reply again."
+}
+
+// enforceGuardrails checks reply and, when it fails, regenerates it once from input
+// with the problems pointed out, falling back to a safe template (the tenant's
+// "guardrail_fallback" prompt). It returns the reply to send, the model that wrote it
+// (guardrailFallbackModel for the template) and, if a guardrail fired, what happened.
+func enforceGuardrails(ctx context.Context, client *http.Client, key, route, model string, input []map[string]any, reply, grounding string) (string, string, guardrailResult) {
+	g := guardrailResult{Violations: checkReply(reply, grounding)}
+	if len(g.Violations) == 0 {
+		return reply, model, g
+	}
+	for _, v := range g.Violations {
+		guardrailViolations.Inc(v.Rule)
+	}
+	g.Draft, g.DraftModel = reply, model
+	retry := append(append([]map[string]any{}, input...), map[string]any{"role": "assistant", "content": reply}, map[string]any{"role": "system", "content": guardrailFeedback(g.Violations)})
+	text, used, attempts := respondWithFallback(ctx, client, key, route, model, retry)
+	g.Attempts, g.Usage = attempts, attemptsUsage(attempts)
+	if used != cannedApologyModel && len(checkReply(text, grounding)) == 0 {
+		g.Action = "regenerated"
+		return text, used, g
+	}
+	g.Action = "fallback"
+	return strings.TrimSpace(promptFor(ctx, "guardrail_fallback", guardrailFallbackReply)), guardrailFallbackModel, g
+}
+
+func guardOrNil(g guardrailResult) any { return ternary[any](g.Action != "", g, nil) }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestCheckReply(t *testing.T) {
+	grounding := groundingText([]string{"Where is order #A-1001? I paid $1,299.00 on March 3rd."}, "Returns are accepted within 30 days.", map[string]any{"order_id": "A-1001", "total_price": "49.90"})
+	cases := []struct {
+		reply string
+		want  []guardrailViolation
+	}{
+		{"Your order #A-1001 is on its way.", []guardrailViolation{}},
+		{"Order #A-1001 was placed on 03/03 for $1299.", []guardrailViolation{}},
+		{"Order #B-2002 shipped.", []guardrailViolation{{"unverified_order_number", "B-2002"}}},
+		{"Your tracking number is 1Z999AA10123456784.", []guardrailViolation{{"unverified_tracking_number", "1Z999AA10123456784"}}},
+		{"You were refunded $45.50.", []guardrailViolation{{"unverified_amount", "$45.50"}}},
+		{"Returns are accepted within 30 days.", []guardrailViolation{}},
+		{"Your return credit is $30.", []guardrailViolation{{"unverified_amount", "$30"}}},
+		{"Your order came to $49.90.", []guardrailViolation{}},
+		{"It will arrive on June 12.", []guardrailViolation{{"unverified_date", "06-12"}}},
+		{"What is your email? And your phone?", []guardrailViolation{{"too_many_questions", "2"}}},
+		{"See https://example.com/help?q=1 — anything else?", []guardrailViolation{}},
+	}
+	for _, tc := range cases {
+		if got := checkReply(tc.reply, grounding); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("checkReply(%q) = %v, want %v", tc.reply, got, tc.want)
+		}
+	}
+}
+
+// TestEnforceGuardrailsFallback checks that a reply replaced by the template is
+// reported as the template's, with the drafting model kept in the result.
+func TestEnforceGuardrailsFallback(t *testing.T) {
+	fake := newFakeBackend(0, 0)
+	fake.Reply = func([]any) string { return "You were refunded $45.50." }
+	useFakeBackend(t, fake)
+	grounding := groundingText([]string{"Where is my refund?"}, "")
+	input := []map[string]any{{"role": "user", "content": "Where is my refund?"}}
+	reply, model, g := enforceGuardrails(context.Background(), &http.Client{}, "test", "returns_refunds", "gpt-5-mini", input, "You were refunded $45.50.", grounding)
+	if reply != guardrailFallbackReply || model != guardrailFallbackModel {
+		t.Errorf("got %q from %q, want the fallback template from %q", reply, model, guardrailFallbackModel)
+	}
+	if g.Action != "fallback" || g.DraftModel != "gpt-5-mini" {
+		t.Errorf("result action %q, draft model %q", g.Action, g.DraftModel)
+	}
+}
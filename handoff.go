@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Address handoff: the address an order status or return workflow carries is sent to
+// the tenant's Shopify store, as a default address of the customer with the user's
+// email, and to Zoho Desk, as the address of the contact with that email. Each send is
+// audited as a tool_calls row ("shopify.address", "zoho_desk.address").
+
+const shopifyAPIVersion = "2025-07"
+
+var errNoHandoffMatch = errors.New("no customer or contact with this email")
+
+// handoffAddress sends a to each of the tenant's enabled Shopify and Zoho Desk
+// integrations.
+func handoffAddress(ctx context.Context, client *http.Client, convID, email string, a address) {
+	for _, name := range []string{"shopify", "zoho_desk"} {
+		s, ok := integrationFor(ctx, name)
+		if !ok {
+			continue
+		}
+		send := ternary(name == "shopify", shopifySetAddress, deskSetAddress)
+		payload := a.forIntegration(name)
+		id, err := send(ctx, client, s, email, payload)
+		status := ternary(err == nil, "success", ternary(errors.Is(err, errNoHandoffMatch), "skipped", "error"))
+		if status == "error" {
+			logFrom(ctx).Warn("address handoff failed", "integration", name, "error", err.Error())
+		}
+		_ = sbInsertToolCall(ctx, client, convID, name+".address", status, map[string]any{"email": email, "address": payload}, map[string]any{"id": nilIfEmpty(id), "error": errToAny(err)})
+	}
+}
+
+// shopifySetAddress adds addr to the Shopify customer with email and makes it their
+// default, returning the customer's id.
+func shopifySetAddress(ctx context.Context, client *http.Client, s map[string]string, email string, addr map[string]any) (string, error) {
+	var found struct {
+		Customers struct {
+			Nodes []struct {
+				ID string `json:"id"`
+			} `json:"nodes"`
+		} `json:"customers"`
+	}
+	if err := shopifyGraphQL(ctx, client, s, `query($q: String!) { customers(first: 1, query: $q) { nodes { id } } }`, map[string]any{"q": fmt.Sprintf("email:%q", email)}, &found); err != nil {
+		return "", err
+	}
+	if len(found.Customers.Nodes) == 0 {
+		return "", errNoHandoffMatch
+	}
+	id := found.Customers.Nodes[0].ID
+	var created struct {
+		CustomerAddressCreate struct {
+			UserErrors []struct {
+				Message string `json:"message"`
+			} `json:"userErrors"`
+		} `json:"customerAddressCreate"`
+	}
+	mutation := `mutation($id: ID!, $address: MailingAddressInput!) { customerAddressCreate(customerId: $id, address: $address, setAsDefault: true) { customerAddress { id } userErrors { message } } }`
+	if err := shopifyGraphQL(ctx, client, s, mutation, map[string]any{"id": id, "address": addr}, &created); err != nil {
+		return id, err
+	}
+	if errs := created.CustomerAddressCreate.UserErrors; len(errs) > 0 {
+		return id, fmt.Errorf("shopify customerAddressCreate: %s", errs[0].Message)
+	}
+	return id, nil
+}
+
+func shopifyGraphQL(ctx context.Context, client *http.Client, s map[string]string, query string, vars map[string]any, out any) error {
+	base := ternary(s["base_url"] != "", s["base_url"], "https://"+s["shop_domain"])
+	version := ternary(s["api_version"] != "", s["api_version"], shopifyAPIVersion)
+	j, _ := json.Marshal(map[string]any{"query": query, "variables": vars})
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(base, "/")+"/admin/api/"+version+"/graphql.json", bytes.NewReader(j))
+	req.Header.Set("X-Shopify-Access-Token", s["access_token"])
+	req.Header.Set("Content-Type", "application/json")
+	res, body, err := doReqWithClient(client, req)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("shopify graphql failed: %d %s", res.StatusCode, truncate(string(body), 300))
+	}
+	var parsed struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return err
+	}
+	if len(parsed.Errors) > 0 {
+		return fmt.Errorf("shopify graphql: %s", parsed.Errors[0].Message)
+	}
+	return json.Unmarshal(parsed.Data, out)
+}
+
+// deskSetAddress sets addr on the Zoho Desk contact with email, returning the
+// contact's id.
+func deskSetAddress(ctx context.Context, client *http.Client, s map[string]string, email string, addr map[string]any) (string, error) {
+	token, err := deskAccessToken(ctx, client, s)
+	if err != nil {
+		return "", err
+	}
+	base := strings.TrimRight(ternary(s["base_url"] != "", s["base_url"], "https://desk.zoho.com"), "/")
+	call := func(method, path string, payload any) ([]byte, error) {
+		var rd io.Reader
+		if payload != nil {
+			j, _ := json.Marshal(payload)
+			rd = bytes.NewReader(j)
+		}
+		req, _ := http.NewRequestWithContext(ctx, method, base+path, rd)
+		req.Header.Set("Authorization", "Zoho-oauthtoken "+token)
+		req.Header.Set("orgId", s["org_id"])
+		req.Header.Set("Content-Type", "application/json")
+		res, body, err := doReqWithClient(client, req)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode >= 400 {
+			return nil, fmt.Errorf("zoho desk %s %s failed: %d %s", method, path, res.StatusCode, truncate(string(body), 300))
+		}
+		return body, nil
+	}
+	body, err := call(http.MethodGet, "/api/v1/contacts/search?limit=1&email="+url.QueryEscape(email), nil)
+	if err != nil {
+		return "", err
+	}
+	// Desk answers a search without matches with 204 and no body.
+	var found struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	_ = json.Unmarshal(body, &found)
+	if len(found.Data) == 0 {
+		return "", errNoHandoffMatch
+	}
+	id := found.Data[0].ID
+	_, err = call(http.MethodPatch, "/api/v1/contacts/"+url.PathEscape(id), addr)
+	return id, err
+}
+
+var (
+	deskTokensMu sync.Mutex
+	deskTokens   = map[string]deskToken{}
+)
+
+type deskToken struct {
+	token string
+	until time.Time
+}
+
+// deskAccessToken is the integration's access_token, or one obtained with its
+// refresh_token, client_id and client_secret and cached per tenant until it expires.
+func deskAccessToken(ctx context.Context, client *http.Client, s map[string]string) (string, error) {
+	if s["refresh_token"] == "" {
+		return s["access_token"], nil
+	}
+	tenant := tenantIDFrom(ctx)
+	deskTokensMu.Lock()
+	t := deskTokens[tenant]
+	deskTokensMu.Unlock()
+	if t.token != "" && time.Now().Before(t.until) {
+		return t.token, nil
+	}
+	form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {s["refresh_token"]}, "client_id": {s["client_id"]}, "client_secret": {s["client_secret"]}}
+	accounts := ternary(s["accounts_url"] != "", s["accounts_url"], "https://accounts.zoho.com")
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(accounts, "/")+"/oauth/v2/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, body, err := doReqWithClient(client, req)
+	if err != nil {
+		return "", err
+	}
+	var parsed struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		Error       string `json:"error"`
+	}
+	_ = json.Unmarshal(body, &parsed)
+	if res.StatusCode >= 400 || parsed.AccessToken == "" {
+		return "", fmt.Errorf("zoho token refresh failed: %d %s", res.StatusCode, ternary(parsed.Error != "", parsed.Error, truncate(string(body), 300)))
+	}
+	// Refresh a minute early so a token never expires mid-call.
+	ttl := time.Duration(max(parsed.ExpiresIn-60, 0)) * time.Second
+	deskTokensMu.Lock()
+	deskTokens[tenant] = deskToken{token: parsed.AccessToken, until: time.Now().Add(ttl)}
+	deskTokensMu.Unlock()
+	return parsed.AccessToken, nil
+}
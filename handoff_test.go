@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestHandoffAddress checks that a workflow address reaches the Shopify customer and
+// the Desk contact with the user's email, and that each send is audited.
+func TestHandoffAddress(t *testing.T) {
+	fake := newFakeBackend(0, 0)
+	useFakeBackend(t, fake)
+	var mu sync.Mutex
+	sent := map[string]map[string]any{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/graphql.json"):
+			var in struct {
+				Query     string         `json:"query"`
+				Variables map[string]any `json:"variables"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&in)
+			if strings.HasPrefix(in.Query, "query") {
+				if in.Variables["q"] != `email:"jane@example.com"` || r.Header.Get("X-Shopify-Access-Token") != "shpat" {
+					writeJSON(w, 200, map[string]any{"data": map[string]any{"customers": map[string]any{"nodes": []any{}}}})
+					return
+				}
+				writeJSON(w, 200, map[string]any{"data": map[string]any{"customers": map[string]any{"nodes": []any{map[string]any{"id": "gid://shopify/Customer/7"}}}}})
+				return
+			}
+			sent["shopify"] = mapOf(in.Variables["address"])
+			sent["shopify"]["customer"] = in.Variables["id"]
+			writeJSON(w, 200, map[string]any{"data": map[string]any{"customerAddressCreate": map[string]any{"userErrors": []any{}}}})
+		case r.URL.Path == "/api/v1/contacts/search":
+			if r.URL.Query().Get("email") != "jane@example.com" || r.Header.Get("orgId") != "42" {
+				w.WriteHeader(204)
+				return
+			}
+			writeJSON(w, 200, map[string]any{"data": []any{map[string]any{"id": "900"}}})
+		case r.Method == http.MethodPatch && r.URL.Path == "/api/v1/contacts/900":
+			var in map[string]any
+			_ = json.NewDecoder(r.Body).Decode(&in)
+			sent["zoho_desk"] = in
+			writeJSON(w, 200, map[string]any{"id": "900"})
+		default:
+			writeJSON(w, 404, map[string]any{})
+		}
+	}))
+	defer upstream.Close()
+
+	ctx := withTenant(context.Background(), Tenant{ID: defaultTenantID, Integrations: map[string]map[string]string{
+		"shopify":   {"base_url": upstream.URL, "access_token": "shpat"},
+		"zoho_desk": {"base_url": upstream.URL, "access_token": "zdt", "org_id": "42"},
+	}})
+	a := address{Line1: "1 Main St", City: "Springfield", State: "IL", PostalCode: "62704", Country: "US"}
+	handoffAddress(ctx, &http.Client{}, "c1", "jane@example.com", a)
+	waitBackground()
+
+	if s := sent["shopify"]; s["customer"] != "gid://shopify/Customer/7" || s["address1"] != "1 Main St" || s["zip"] != "62704" || s["countryCode"] != "US" {
+		t.Errorf("shopify got %v", s)
+	}
+	if d := sent["zoho_desk"]; d["street"] != "1 Main St" || d["city"] != "Springfield" || d["zip"] != "62704" {
+		t.Errorf("zoho desk got %v", d)
+	}
+	status := map[string]any{}
+	for _, row := range fake.Rows("tool_calls") {
+		status[asString(row["tool_name"])] = row["status"]
+	}
+	if status["shopify.address"] != "success" || status["zoho_desk.address"] != "success" {
+		t.Errorf("tool_calls statuses %v", status)
+	}
+
+	handoffAddress(ctx, &http.Client{}, "c1", "someone@example.com", a)
+	waitBackground()
+	skipped := 0
+	for _, row := range fake.Rows("tool_calls") {
+		skipped += ternary(row["status"] == "skipped", 1, 0)
+	}
+	if skipped != 2 {
+		t.Errorf("unknown email: %d skipped tool_calls, want 2", skipped)
+	}
+}
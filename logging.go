@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+type ctxKey int
+
+const (
+	requestIDKey ctxKey = iota
+	spanKey
+	tenantKey
+)
+
+// logLevel is shared by every logger so a config reload can change verbosity in place.
+var logLevel = new(slog.LevelVar)
+
+var logger = newLogger("json", "info")
+
+func newLogger(format, level string) *slog.Logger {
+	var lv slog.Level
+	if err := lv.UnmarshalText([]byte(level)); err != nil {
+		lv = slog.LevelInfo
+	}
+	logLevel.Set(lv)
+	opts := &slog.HandlerOptions{Level: logLevel}
+	if strings.EqualFold(format, "text") {
+		return slog.New(slog.NewTextHandler(os.Stdout, opts))
+	}
+	return slog.New(slog.NewJSONHandler(os.Stdout, opts))
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// logFrom returns the process logger tagged with the request and trace ids carried by ctx.
+func logFrom(ctx context.Context) *slog.Logger {
+	l := logger
+	if id := requestIDFrom(ctx); id != "" {
+		l = l.With("request_id", id)
+	}
+	if s := spanFrom(ctx); s != nil {
+		l = l.With("trace_id", s.TraceID())
+	}
+	if t, ok := tenantFrom(ctx); ok {
+		l = l.With("tenant_id", t.ID)
+	}
+	return l
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+// requestIDMiddleware accepts an inbound X-Request-Id (or mints one), echoes it on the
+// response and logs one line per request once the handler returns.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSpace(r.Header.Get(requestIDHeader))
+		if id == "" || len(id) > 128 {
+			id = newUUID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		rec := &statusRecorder{ResponseWriter: w}
+		t0 := time.Now()
+		next.ServeHTTP(rec, r.WithContext(withRequestID(r.Context(), id)))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		lv := slog.LevelInfo
+		if rec.status >= 500 {
+			lv = slog.LevelError
+		}
+		logger.Log(r.Context(), lv, "http request", "request_id", id, "method", r.Method, "path", r.URL.Path, "status", rec.status, "bytes", rec.bytes, "latency_ms", time.Since(t0).Milliseconds())
+	})
+}
+
+// upstreamOf names the backend an outbound request is addressed to.
+func upstreamOf(req *http.Request) string {
+	if strings.HasPrefix(req.URL.Path, "/rest/v1/") {
+		return "supabase"
+	}
+	if strings.HasPrefix(req.URL.Path, "/v1/") {
+		return "openai"
+	}
+	return req.URL.Host
+}
+
+func logUpstream(req *http.Request, status int, latency time.Duration, err error) {
+	l := logFrom(req.Context())
+	attrs := []any{"upstream", upstreamOf(req), "method", req.Method, "path", req.URL.Path, "status", status, "latency_ms", latency.Milliseconds()}
+	switch {
+	case err != nil:
+		l.Error("upstream call failed", append(attrs, "error", err.Error())...)
+	case status >= 400:
+		l.Warn("upstream call returned error status", attrs...)
+	default:
+		l.Info("upstream call", attrs...)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal Prometheus text-format registry; enough for counters, gauges and histograms
+// with labels, without pulling in the client library.
+
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 40, 60}
+
+type metric interface {
+	write(b *strings.Builder)
+}
+
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu      sync.Mutex
+	values  map[string]float64
+	hists   map[string]*histogram
+	buckets []float64
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+func register(m *metricVec) *metricVec {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, m)
+	return m
+}
+
+func newCounterVec(name, help string, labels ...string) *metricVec {
+	return register(&metricVec{name: name, help: help, kind: "counter", labels: labels, values: map[string]float64{}})
+}
+
+func newGaugeVec(name, help string, labels ...string) *metricVec {
+	return register(&metricVec{name: name, help: help, kind: "gauge", labels: labels, values: map[string]float64{}})
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *metricVec {
+	return register(&metricVec{name: name, help: help, kind: "histogram", labels: labels, hists: map[string]*histogram{}, buckets: buckets})
+}
+
+func (m *metricVec) key(lvs []string) string {
+	if len(lvs) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s: want %d label values, got %d", m.name, len(m.labels), len(lvs)))
+	}
+	return strings.Join(lvs, "\xff")
+}
+
+func (m *metricVec) Add(v float64, lvs ...string) {
+	k := m.key(lvs)
+	m.mu.Lock()
+	m.values[k] += v
+	m.mu.Unlock()
+}
+
+func (m *metricVec) Set(v float64, lvs ...string) {
+	k := m.key(lvs)
+	m.mu.Lock()
+	m.values[k] = v
+	m.mu.Unlock()
+}
+
+func (m *metricVec) Inc(lvs ...string) { m.Add(1, lvs...) }
+func (m *metricVec) Dec(lvs ...string) { m.Add(-1, lvs...) }
+
+func (m *metricVec) Observe(v float64, lvs ...string) {
+	k := m.key(lvs)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.hists[k]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		m.hists[k] = h
+	}
+	for i, ub := range m.buckets {
+		if v <= ub {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (m *metricVec) labelString(k string, extra ...string) string {
+	pairs := []string{}
+	if len(m.labels) > 0 {
+		for i, v := range strings.Split(k, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", m.labels[i], v))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *metricVec) write(b *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	if m.kind != "histogram" {
+		for _, k := range sortedKeys(m.values) {
+			fmt.Fprintf(b, "%s%s %s\n", m.name, m.labelString(k), formatFloat(m.values[k]))
+		}
+		return
+	}
+	for _, k := range sortedKeys(m.hists) {
+		h := m.hists[k]
+		for i, ub := range m.buckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", m.name, m.labelString(k, "le", formatFloat(ub)), h.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", m.name, m.labelString(k, "le", "+Inf"), h.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", m.name, m.labelString(k), formatFloat(h.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", m.name, m.labelString(k), h.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	chatStageSeconds  = newHistogramVec("chatbot_chat_stage_duration_seconds", "Chat turn latency by pipeline stage.", latencyBuckets, "stage")
+	extractorFailures = newCounterVec("chatbot_extractor_failures_total", "Extractor LLM calls that failed; the rule-based fields were used.")
+	upstreamResponses = newCounterVec("chatbot_upstream_responses_total", "Outbound responses by upstream and status code (\"error\" for transport failures).", "upstream", "status")
+	upstreamSeconds   = newHistogramVec("chatbot_upstream_duration_seconds", "Outbound call latency by upstream.", latencyBuckets, "upstream")
+	modelRequests     = newCounterVec("chatbot_model_requests_total", "OpenAI Responses requests by model.", "model")
+	activeStreamConns = newGaugeVec("chatbot_active_stream_connections", "Open SSE/WebSocket connections.", "kind")
+)
+
+func init() {
+	extractorFailures.Add(0)
+	for _, kind := range []string{"sse", "websocket"} {
+		activeStreamConns.Add(0, kind)
+	}
+}
+
+// observeStage records the time elapsed since t0 for one chat pipeline stage and
+// returns the current time so stages can be chained.
+func observeStage(stage string, t0 time.Time) time.Time {
+	now := time.Now()
+	chatStageSeconds.Observe(now.Sub(t0).Seconds(), stage)
+	return now
+}
+
+func observeUpstream(req *http.Request, status int, latency time.Duration) {
+	code := "error"
+	if status > 0 {
+		code = strconv.Itoa(status)
+	}
+	up := upstreamOf(req)
+	upstreamResponses.Inc(up, code)
+	upstreamSeconds.Observe(latency.Seconds(), up)
+}
+
+// trackStream marks a streaming connection of the given kind ("sse", "websocket") as
+// open; call the returned func when it closes. Chat replies are not streamed yet, so
+// the gauge stays at zero until a streaming handler calls this.
+func trackStream(kind string) func() {
+	activeStreamConns.Inc(kind)
+	var once sync.Once
+	return func() { once.Do(func() { activeStreamConns.Dec(kind) }) }
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	registryMu.Lock()
+	ms := append([]metric(nil), registry...)
+	registryMu.Unlock()
+	b := &strings.Builder{}
+	for _, m := range ms {
+		m.write(b)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write([]byte(b.String()))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const cannedApologyModel = "canned_apology"
+
+// fallbackChain returns the ordered, de-duplicated models to try for a route, starting
+// with the selected model. The per-route lists come from openai.model_fallbacks
+// (MODEL_FALLBACKS="default=gpt-4o-mini,gpt-4.1-nano;order_support=gpt-4o-mini").
+// When every model fails the turn is answered with unavailableReply.
+func fallbackChain(ctx context.Context, route, selected string) []string {
+	fallbacks := configFor(ctx).ModelFallbacks
+	next, ok := fallbacks[route]
+	if !ok {
+		next = fallbacks["default"]
+	}
+	seen := map[string]bool{}
+	chain := []string{}
+	for _, m := range append([]string{selected}, next...) {
+		if m != "" && !seen[m] {
+			seen[m] = true
+			chain = append(chain, m)
+		}
+	}
+	return chain
+}
+
+type modelAttempt struct {
+	Model     string      `json:"model"`
+	Error     string      `json:"error,omitempty"`
+	LatencyMS int64       `json:"latency_ms"`
+	Usage     *tokenUsage `json:"usage,omitempty"`
+}
+
+// attemptsUsage is the usage of the attempt that produced the reply, if any.
+func attemptsUsage(attempts []modelAttempt) tokenUsage {
+	if n := len(attempts); n > 0 && attempts[n-1].Usage != nil {
+		return *attempts[n-1].Usage
+	}
+	return tokenUsage{}
+}
+
+// chatTurnReserve is the part of http.write_timeout kept for the rest of a chat turn:
+// loading it, saving it and writing the response.
+const chatTurnReserve = 15 * time.Second
+
+// withModelDeadline bounds all model calls of a turn that started at start (the
+// fallback chain, its retries and a guardrail regeneration) so the reply still goes
+// out within http.write_timeout.
+func withModelDeadline(ctx context.Context, start time.Time) (context.Context, context.CancelFunc) {
+	wt := getConfig().HTTP.WriteTimeout
+	if wt <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, start.Add(wt-chatTurnReserve))
+}
+
+// respondWithFallback walks the route's fallback chain until a model returns text. It
+// never fails: if the whole chain errors, or ctx's deadline passes first, the reply is
+// the canned apology and the model is reported as cannedApologyModel.
+func respondWithFallback(ctx context.Context, client *http.Client, key, route, selected string, input []map[string]any) (reply, modelUsed string, attempts []modelAttempt) {
+	ctx, span := startSpan(ctx, "chat.respond", "route", route, "selected_model", selected)
+	defer span.End()
+	for _, model := range fallbackChain(ctx, route, selected) {
+		timeout := configFor(ctx).ChatModelTimeout
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = min(timeout, time.Until(deadline))
+		}
+		if timeout <= 0 {
+			logFrom(ctx).Warn("chat model deadline passed", "model", model, "route", route)
+			break
+		}
+		t0 := time.Now()
+		r, err := openAIResponses(ctx, client, key, map[string]any{"model": model, "input": input, "text": map[string]any{"format": map[string]any{"type": "text"}}}, timeout)
+		a := modelAttempt{Model: model, LatencyMS: time.Since(t0).Milliseconds()}
+		if err != nil {
+			a.Error = truncate(err.Error(), 500)
+			attempts = append(attempts, a)
+			logFrom(ctx).Warn("chat model failed", "model", model, "route", route, "error", a.Error)
+			continue
+		}
+		u := usageOf(model, r)
+		a.Usage = &u
+		attempts = append(attempts, a)
+		text := strings.TrimSpace(responsesText(r))
+		if text == "" {
+			text = "(No text returned.)"
+		}
+		span.SetAttrs("model_used", model)
+		return text, model, attempts
+	}
+	span.SetAttrs("model_used", cannedApologyModel)
+	return unavailableReply, cannedApologyModel, attempts
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "…"
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestRespondWithFallbackDeadline checks that a slow chain stops at the turn's model
+// deadline instead of giving every model its full timeout.
+func TestRespondWithFallbackDeadline(t *testing.T) {
+	fake := newFakeBackend(0, 300*time.Millisecond)
+	useFakeBackend(t, fake)
+	updateConfig(func(c *RuntimeConfig) {
+		c.ChatModelTimeout = time.Minute
+		c.ModelFallbacks = map[string][]string{"default": {"gpt-4o-mini", "gpt-4.1-nano"}}
+		c.HTTP.WriteTimeout = chatTurnReserve + 100*time.Millisecond
+	})
+	ctx, cancel := withModelDeadline(context.Background(), time.Now())
+	defer cancel()
+	t0 := time.Now()
+	reply, used, attempts := respondWithFallback(ctx, &http.Client{}, "test", "default", "gpt-5-mini", []map[string]any{{"role": "user", "content": "hi"}})
+	if used != cannedApologyModel || reply != unavailableReply {
+		t.Errorf("used %s, want the canned apology", used)
+	}
+	if len(attempts) != 1 {
+		t.Errorf("%d models tried after the deadline, want 1", len(attempts))
+	}
+	if d := time.Since(t0); d > 250*time.Millisecond {
+		t.Errorf("took %v, want the 100ms deadline", d)
+	}
+}
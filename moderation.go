@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Every inbound message and every reply is classified into a fixed set of
+// categories, and moderation.policy says what a flagged category does: warn lets the
+// turn go on with a warning, block answers with a refusal instead of calling the chat
+// model, escalate answers with a handoff message and marks the conversation for a
+// human. Flagged replies are never sent.
+
+const (
+	moderationAllow    = "allow"
+	moderationWarn     = "warn"
+	moderationBlock    = "block"
+	moderationEscalate = "escalate"
+	moderationModel    = "moderation"
+)
+
+var moderationCategories = []string{"harassment", "hate", "self_harm", "sexual", "sexual_minors", "violence", "illicit"}
+
+var defaultModerationPolicy = map[string]string{
+	"harassment": moderationWarn, "hate": moderationBlock, "self_harm": moderationEscalate, "sexual": moderationBlock,
+	"sexual_minors": moderationBlock, "violence": moderationEscalate, "illicit": moderationBlock,
+}
+
+// parseModerationPolicy reads "harassment=warn,self_harm=escalate"; categories not
+// listed keep their default action.
+func parseModerationPolicy(v string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, part := range splitCSV(v) {
+		k, action, _ := strings.Cut(part, "=")
+		k, action = strings.TrimSpace(k), strings.TrimSpace(action)
+		if !containsString(moderationCategories, k) {
+			return nil, fmt.Errorf("unknown category %q (%s)", k, strings.Join(moderationCategories, ", "))
+		}
+		if !containsString([]string{moderationAllow, moderationWarn, moderationBlock, moderationEscalate}, action) {
+			return nil, fmt.Errorf("%s: action must be allow, warn, block or escalate", k)
+		}
+		out[k] = action
+	}
+	return out, nil
+}
+
+// moderationClassifier returns the categories text falls into.
+type moderationClassifier interface {
+	name() string
+	classify(ctx context.Context, client *http.Client, key, text string) ([]string, error)
+}
+
+// newModerationClassifier returns the classifier named by moderation.classifier, or
+// nil for "none".
+func newModerationClassifier(c RuntimeConfig) moderationClassifier {
+	switch c.Moderation {
+	case "openai":
+		return openAIModeration{model: c.ModerationModel}
+	case "local":
+		return localModeration{}
+	}
+	return nil
+}
+
+// localModeration matches keyword patterns. It needs no network and errs towards
+// missing things; it is also what the OpenAI classifier falls back to.
+type localModeration struct{}
+
+var localModerationRules = map[string]*regexp.Regexp{
+	"self_harm":     regexp.MustCompile(`(?i)\b(kill(ing)? myself|end(ing)? my life|suicid(e|al)|want to die|self[- ]?harm|cut(ting)? myself|hurt(ing)? myself|don'?t want to (live|be alive)|no reason to live)\b`),
+	"violence":      regexp.MustCompile(`(?i)\bi('ll| will| am going to|'m going to| gonna) ((kill|hurt|stab|beat up|murder) (you|him|her|them)\b|shoot (you|him|her|them) (dead|in the)\b|shoot (you|him|her|them)[.!]*\s*$|(kill|hurt|stab|shoot) (your|his|her|their) (family|kids|children|wife|husband|son|daughter|mom|mother|dad|father)\b)|\b(bomb threat|shoot up the|blow up (the|your) (store|shop|office|building|warehouse|house))\b`),
+	"harassment":    regexp.MustCompile(`(?i)(\b(you('re| are)|ur|u r) (an? |such an? |so )?(idiot|stupid|moron|useless|worthless|pathetic|dumb|retard)\b|\bshut up\b|\bf+u+c+k+ (you|off|u)\b|\bscrew you\b|\bpiece of (shit|crap)\b|\bgo to hell\b|\b(bitch|bastard|asshole|dickhead)\b)`),
+	"hate":          regexp.MustCompile(`(?i)\b((all|those|these) \w+ (should|must|deserve to) (die|be killed|be exterminated|be gassed)|subhuman|go back to your (own )?country)\b`),
+	"sexual":        regexp.MustCompile(`(?i)\b(send (me )?nudes?|sexting|porn|send (me )?(pics|photos|pictures) of (you|yourself)|wanna (have )?sex)\b`),
+	"sexual_minors": regexp.MustCompile(`(?i)\b((child|minor|underage|kid|teen)s? (porn|sex|nudes?|naked))\b`),
+	"illicit":       regexp.MustCompile(`(?i)\b(how (do i|to|can i) (make|build|buy|get) (a |an |some )?(bomb|meth|explosives?|fake ids?|counterfeit \w+|untraceable gun)|buy stolen (credit )?cards?|launder (money|cash))\b`),
+}
+
+func (localModeration) name() string { return "local" }
+
+func (localModeration) classify(_ context.Context, _ *http.Client, _, text string) ([]string, error) {
+	out := []string{}
+	for _, c := range moderationCategories {
+		if localModerationRules[c].MatchString(text) {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// openAIModeration calls the moderation endpoint; its categories are folded into
+// ours ("self-harm/intent" → self_harm).
+type openAIModeration struct{ model string }
+
+var openAIModerationCategories = map[string]string{
+	"harassment": "harassment", "harassment/threatening": "violence", "hate": "hate", "hate/threatening": "hate",
+	"self-harm": "self_harm", "self-harm/intent": "self_harm", "self-harm/instructions": "self_harm",
+	"sexual": "sexual", "sexual/minors": "sexual_minors", "violence": "violence", "violence/graphic": "violence",
+	"illicit": "illicit", "illicit/violent": "illicit",
+}
+
+func (openAIModeration) name() string { return "openai" }
+
+func (m openAIModeration) classify(ctx context.Context, client *http.Client, key, text string) ([]string, error) {
+	j, _ := json.Marshal(map[string]any{"model": m.model, "input": text})
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, getConfig().OpenAIBaseURL+"/v1/moderations", bytes.NewReader(j))
+	req.Header.Set("Authorization", "Bearer "+key)
+	req.Header.Set("Content-Type", "application/json")
+	cl := *client
+	cl.Timeout = 10 * time.Second
+	res, body, err := doReqWithClient(&cl, req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 400 {
+		return nil, fmt.Errorf("openai moderation error %d: %s", res.StatusCode, truncate(string(body), 300))
+	}
+	var parsed struct {
+		Results []struct {
+			Categories map[string]bool `json:"categories"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, err
+	}
+	out := []string{}
+	for _, r := range parsed.Results {
+		for k, flagged := range r.Categories {
+			if c := openAIModerationCategories[k]; flagged && c != "" && !containsString(out, c) {
+				out = append(out, c)
+			}
+		}
+	}
+	return sortedStrings(out), nil
+}
+
+// moderationResult is stored on the message payload and in moderation events.
+type moderationResult struct {
+	Classifier string   `json:"classifier"`
+	Flagged    bool     `json:"flagged"`
+	Categories []string `json:"categories,omitempty"`
+	Action     string   `json:"action"`
+	Error      string   `json:"error,omitempty"`
+}
+
+var moderationFlags = newCounterVec("chatbot_moderation_flagged_total", "Messages flagged by moderation, by direction, category and action.", "direction", "category", "action")
+
+// moderate classifies text and applies the policy. When the configured classifier
+// fails the local one is used instead.
+func moderate(ctx context.Context, client *http.Client, key, direction, text string) moderationResult {
+	c := configFor(ctx)
+	mc := newModerationClassifier(c)
+	if mc == nil {
+		return moderationResult{Classifier: "none", Action: moderationAllow}
+	}
+	ctx, span := startSpan(ctx, "moderation", "classifier", mc.name(), "direction", direction)
+	defer span.End()
+	r := moderationResult{Classifier: mc.name(), Action: moderationAllow}
+	cats, err := mc.classify(ctx, client, key, text)
+	if err != nil {
+		span.RecordError(err)
+		r.Error = truncate(err.Error(), 300)
+		r.Classifier = "local"
+		cats, _ = localModeration{}.classify(ctx, client, key, text)
+	}
+	r.Categories, r.Flagged = cats, len(cats) > 0
+	rank := map[string]int{moderationAllow: 0, moderationWarn: 1, moderationBlock: 2, moderationEscalate: 3}
+	for _, cat := range cats {
+		action, ok := c.ModerationPolicy[cat]
+		if !ok {
+			action = defaultModerationPolicy[cat]
+		}
+		moderationFlags.Inc(direction, cat, action)
+		if rank[action] > rank[r.Action] {
+			r.Action = action
+		}
+	}
+	return r
+}
+
+var (
+	moderationBlockReply    = "I can't help with that. If you have a question about an order, a product or your account, I'm happy to help."
+	moderationEscalateReply = "I'm really sorry you're dealing with this. I've passed our conversation to a member of our team. If you or someone else is in immediate danger, please contact your local emergency number right away."
+	moderationSelfHarmReply = "I'm really sorry you're feeling this way, and I'm glad you said something. You don't have to go through this alone: if you're in immediate danger please call your local emergency number, or in the US call or text 988 to reach the Suicide & Crisis Lifeline. I've also let a member of our team know."
+	moderationWarning       = "Please keep this conversation respectful."
+)
+
+// moderationReply is what the user gets instead of a model reply for blocked and
+// escalated messages; tenants can replace the texts with the moderation_block and
+// moderation_escalate prompts.
+func moderationReply(ctx context.Context, r moderationResult) string {
+	if r.Action == moderationEscalate {
+		def := ternary(containsString(r.Categories, "self_harm"), moderationSelfHarmReply, moderationEscalateReply)
+		return strings.TrimSpace(promptFor(ctx, "moderation_escalate", def))
+	}
+	return strings.TrimSpace(promptFor(ctx, "moderation_block", moderationBlockReply))
+}
+
+func moderationNote(r moderationResult) string {
+	if r.Action != moderationWarn {
+		return ""
+	}
+	return fmt.Sprintf("The user's message was flagged for %s. Stay calm and polite, do not repeat or engage with it, and steer back to how you can help.", strings.ReplaceAll(strings.Join(r.Categories, ", "), "_", " "))
+}
+
+func sortedStrings(in []string) []string {
+	m := map[string]bool{}
+	for _, s := range in {
+		m[s] = true
+	}
+	return sortedKeys(m)
+}
+
+// turnWarning is shown to the user under the reply.
+func turnWarning(pii []piiFinding, mod moderationResult) any {
+	w := strings.TrimSpace(piiWarning(pii) + " " + ternary(mod.Action == moderationWarn, moderationWarning, ""))
+	return ternary[any](w != "", w, nil)
+}
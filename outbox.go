@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// outbox is a durable local queue for audit rows (events, tool_calls). Rows are
+// appended to a JSON-lines log and fsynced before Enqueue returns; a single flusher
+// posts them to Supabase strictly in enqueue order, batching consecutive rows for the
+// same table. The highest flushed seq is kept in <path>.ack so a restart resumes where
+// it stopped. A batch Supabase rejects as invalid is split in halves until the bad
+// rows are alone; a row it keeps rejecting on its own goes to <path>.dead instead of
+// blocking the queue. Only row-level errors (400, 409, 422) count as invalid; 401, 403
+// and 404 stall the queue and set chatbot_outbox_stalled until the setup is fixed. Delivery is at-least-once. Scrub rewrites both files for
+// privacy erasures.
+type outbox struct {
+	path string
+
+	mu          sync.Mutex
+	f           *os.File
+	pending     []*outboxRecord
+	nextSeq     int64
+	lastErr     string
+	lastErrAt   time.Time
+	deadLetters int
+	batchLimit  int        // shrinks while bisecting a rejected batch
+	flushMu     sync.Mutex // held while a batch is in flight
+
+	wake     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	started  bool
+	stopOnce sync.Once
+}
+
+type outboxRecord struct {
+	Seq        int64          `json:"seq"`
+	Table      string         `json:"table"`
+	Row        map[string]any `json:"row"`
+	EnqueuedAt time.Time      `json:"enqueued_at"`
+	attempts   int
+}
+
+const (
+	outboxBatchSize   = 100
+	outboxMaxAttempts = 5
+)
+
+var outboxQ *outbox
+
+var (
+	outboxDepth   = newGaugeVec("chatbot_outbox_depth", "Audit rows waiting in the local outbox.")
+	outboxStalled = newGaugeVec("chatbot_outbox_stalled", "1 while Supabase refuses outbox flushes for a reason no row can fix (401, 403, 404).")
+)
+
+func openOutbox(path string) (*outbox, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	o := &outbox{path: path, nextSeq: 1, batchLimit: outboxBatchSize, wake: make(chan struct{}, 1), stop: make(chan struct{}), done: make(chan struct{})}
+	acked := int64(0)
+	if b, err := os.ReadFile(path + ".ack"); err == nil {
+		acked, _ = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	}
+	if f, err := os.Open(path); err == nil {
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 1<<20), 16<<20)
+		for sc.Scan() {
+			var rec outboxRecord
+			if json.Unmarshal(sc.Bytes(), &rec) != nil {
+				// A torn final line from a crash mid-append; everything before it is intact.
+				continue
+			}
+			if rec.Seq >= o.nextSeq {
+				o.nextSeq = rec.Seq + 1
+			}
+			if rec.Seq > acked {
+				o.pending = append(o.pending, &rec)
+			}
+		}
+		f.Close()
+	}
+	if acked >= o.nextSeq {
+		o.nextSeq = acked + 1
+	}
+	// Rewrite the log with just the pending rows; this also drops any torn line so new
+	// appends never continue a partial record.
+	if err := o.rewriteLog(); err != nil {
+		return nil, err
+	}
+	outboxDepth.Add(float64(len(o.pending)))
+	outboxStalled.Set(0)
+	if len(o.pending) > 0 {
+		logger.Info("outbox recovered pending rows", "path", path, "pending", len(o.pending))
+	}
+	return o, nil
+}
+
+// rewriteLog replaces the log with the pending rows and reopens it for appending.
+// Callers other than openOutbox hold o.mu.
+func (o *outbox) rewriteLog() error {
+	tmp := o.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	for _, rec := range o.pending {
+		line, _ := json.Marshal(rec)
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, o.path); err != nil {
+		return err
+	}
+	if o.f != nil {
+		o.f.Close()
+	}
+	o.f, err = os.OpenFile(o.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	return err
+}
+
+func (o *outbox) Enqueue(table string, row map[string]any) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	rec := &outboxRecord{Seq: o.nextSeq, Table: table, Row: row, EnqueuedAt: time.Now().UTC()}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := o.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := o.f.Sync(); err != nil {
+		return err
+	}
+	o.nextSeq++
+	o.pending = append(o.pending, rec)
+	outboxDepth.Inc()
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Start runs the background flusher until Drain is called.
+func (o *outbox) Start() {
+	o.started = true
+	go func() {
+		defer close(o.done)
+		tick := time.NewTicker(time.Second)
+		defer tick.Stop()
+		backoff := time.Duration(0)
+		for {
+			select {
+			case <-o.stop:
+				return
+			case <-o.wake:
+			case <-tick.C:
+			}
+			if backoff > 0 && time.Since(o.lastErrorAt()) < backoff {
+				continue
+			}
+			if err := o.flushAll(context.Background()); err != nil {
+				backoff = min(max(2*backoff, time.Second), 30*time.Second)
+				continue
+			}
+			backoff = 0
+		}
+	}()
+}
+
+// Drain stops the background flusher and flushes what is left until the queue is
+// empty or ctx expires. Anything not flushed stays on disk for the next start.
+func (o *outbox) Drain(ctx context.Context) error {
+	o.stopOnce.Do(func() { close(o.stop) })
+	if o.started {
+		<-o.done
+	}
+	for {
+		err := o.flushAll(ctx)
+		if err == nil {
+			return nil
+		}
+		if !sleepCtx(ctx, 500*time.Millisecond) {
+			return fmt.Errorf("outbox drain: %d rows left: %w", o.Depth(), err)
+		}
+	}
+}
+
+func (o *outbox) flushAll(ctx context.Context) error {
+	for {
+		o.flushMu.Lock()
+		n, err := o.flushBatch(ctx)
+		o.flushMu.Unlock()
+		if err != nil || n == 0 {
+			return err
+		}
+	}
+}
+
+// flushBatch posts the longest same-table, same-tenant run at the head of the queue.
+func (o *outbox) flushBatch(ctx context.Context) (int, error) {
+	o.mu.Lock()
+	if len(o.pending) == 0 {
+		o.mu.Unlock()
+		return 0, nil
+	}
+	table, tenant := o.pending[0].Table, asString(o.pending[0].Row["tenant_id"])
+	batch := []*outboxRecord{}
+	for _, rec := range o.pending {
+		if rec.Table != table || asString(rec.Row["tenant_id"]) != tenant || len(batch) == o.batchLimit {
+			break
+		}
+		batch = append(batch, rec)
+	}
+	o.mu.Unlock()
+
+	rows := make([]map[string]any, 0, len(batch))
+	for _, rec := range batch {
+		rows = append(rows, rec.Row)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	res, err := sbPost(withTenant(ctx, tenantByID(ternary(tenant != "", tenant, defaultTenantID))), client, table, rows, nil, "return=minimal")
+	if err == nil && res.StatusCode >= 400 {
+		err = fmt.Errorf("%s insert failed: %d %s", table, res.StatusCode, truncate(readBody(res), 300))
+	}
+	if err == nil {
+		outboxStalled.Set(0)
+		o.ack(batch, "")
+		o.mu.Lock()
+		o.batchLimit = min(2*o.batchLimit, outboxBatchSize)
+		o.mu.Unlock()
+		return len(batch), nil
+	}
+	stalled := res != nil && (res.StatusCode == 401 || res.StatusCode == 403 || res.StatusCode == 404)
+	attempts := o.recordFailure(batch[0], err, !stalled)
+	if stalled {
+		// A bad key, a permission change or a missing table: no row is at fault, so
+		// keep the queue and retry with backoff until someone fixes the setup. These
+		// failures do not count towards dead-lettering the head row.
+		outboxStalled.Set(1)
+		logger.Error("outbox flush rejected, check the Supabase key, permissions and schema", "table", table, "rows", len(batch), "attempt", attempts, "error", err.Error())
+		return 0, err
+	}
+	if res != nil && (res.StatusCode == 400 || res.StatusCode == 409 || res.StatusCode == 422) {
+		if len(batch) > 1 {
+			// Some row is invalid: try the first half alone, so valid rows get through
+			// and the bad ones end up alone at the head.
+			o.mu.Lock()
+			o.batchLimit = len(batch) / 2
+			o.mu.Unlock()
+			logger.Warn("outbox batch rejected, splitting", "table", table, "rows", len(batch), "error", err.Error())
+			return o.flushBatch(ctx)
+		}
+		if attempts >= outboxMaxAttempts {
+			// The row itself is bad; park it so later rows keep flowing.
+			o.ack(batch, err.Error())
+			return len(batch), nil
+		}
+	}
+	logger.Warn("outbox flush failed", "table", table, "rows", len(batch), "attempt", attempts, "error", err.Error())
+	return 0, err
+}
+
+// ack drops batch from the head of the queue, persisting the new high-water mark.
+// A non-empty deadReason appends the rows to the dead-letter file first.
+func (o *outbox) ack(batch []*outboxRecord, deadReason string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if deadReason != "" {
+		if f, err := os.OpenFile(o.path+".dead", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600); err == nil {
+			for _, rec := range batch {
+				line, _ := json.Marshal(map[string]any{"record": rec, "error": deadReason, "dead_at": isoNow()})
+				_, _ = f.Write(append(line, '\n'))
+			}
+			f.Close()
+		}
+		o.deadLetters += len(batch)
+		logger.Error("outbox rows dead-lettered", "table", batch[0].Table, "rows", len(batch), "error", deadReason)
+	}
+	o.pending = o.pending[len(batch):]
+	outboxDepth.Add(-float64(len(batch)))
+	last := batch[len(batch)-1].Seq
+	tmp := o.path + ".ack.tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(last, 10)), 0o600); err == nil {
+		_ = os.Rename(tmp, o.path+".ack")
+	}
+	if len(o.pending) == 0 {
+		// Everything is flushed: start a fresh log so it does not grow forever.
+		_ = o.f.Truncate(0)
+	}
+}
+
+// Scrub passes every queued and dead-lettered row to fn and rewrites both files.
+// For the rows fn matches it keeps the row fn returns, or drops it if that is nil;
+// it returns how many matched. It waits for an in-flight batch, so a dropped row
+// cannot still reach Supabase afterwards.
+func (o *outbox) Scrub(fn func(table string, row map[string]any) (map[string]any, bool)) (int, error) {
+	o.flushMu.Lock()
+	defer o.flushMu.Unlock()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n, kept := 0, o.pending[:0:0]
+	for _, rec := range o.pending {
+		row, matched := fn(rec.Table, rec.Row)
+		if matched {
+			n++
+			rec.Row = row
+		}
+		if rec.Row != nil {
+			kept = append(kept, rec)
+		}
+	}
+	outboxDepth.Add(-float64(len(o.pending) - len(kept)))
+	o.pending = kept
+	if err := o.rewriteLog(); err != nil {
+		return n, err
+	}
+
+	b, err := os.ReadFile(o.path + ".dead")
+	if os.IsNotExist(err) {
+		return n, nil
+	} else if err != nil {
+		return n, err
+	}
+	var out []byte
+	for _, line := range strings.Split(string(b), "\n") {
+		if line == "" {
+			continue
+		}
+		var dead struct {
+			Record outboxRecord `json:"record"`
+			Error  string       `json:"error"`
+			DeadAt string       `json:"dead_at"`
+		}
+		if json.Unmarshal([]byte(line), &dead) == nil {
+			row, matched := fn(dead.Record.Table, dead.Record.Row)
+			if matched {
+				n++
+				if row == nil {
+					o.deadLetters = max(o.deadLetters-1, 0)
+					continue
+				}
+				dead.Record.Row = row
+				l, _ := json.Marshal(map[string]any{"record": dead.Record, "error": dead.Error, "dead_at": dead.DeadAt})
+				line = string(l)
+			}
+		}
+		out = append(out, line+"\n"...)
+	}
+	tmp := o.path + ".dead.tmp"
+	if err := os.WriteFile(tmp, out, 0o600); err != nil {
+		return n, err
+	}
+	return n, os.Rename(tmp, o.path+".dead")
+}
+
+func (o *outbox) recordFailure(head *outboxRecord, err error, count bool) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if count {
+		head.attempts++
+	}
+	o.lastErr, o.lastErrAt = err.Error(), time.Now()
+	return head.attempts
+}
+
+func (o *outbox) lastErrorAt() time.Time {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.lastErrAt
+}
+
+func (o *outbox) Depth() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+func (o *outbox) Status() map[string]any {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	st := map[string]any{"depth": len(o.pending), "dead_letters": o.deadLetters, "oldest_pending": nil, "last_error": nil}
+	if len(o.pending) > 0 {
+		head := o.pending[0]
+		st["oldest_pending"] = map[string]any{"seq": head.Seq, "table": head.Table, "enqueued_at": head.EnqueuedAt.Format(time.RFC3339), "age_seconds": int(time.Since(head.EnqueuedAt).Seconds()), "attempts": head.attempts}
+	}
+	if o.lastErr != "" {
+		st["last_error"] = map[string]any{"error": o.lastErr, "at": o.lastErrAt.UTC().Format(time.RFC3339)}
+	}
+	return st
+}
+
+// writeAudit routes an audit row through the outbox, or straight to Supabase when no
+// outbox is running (bench and one-off commands).
+func writeAudit(ctx context.Context, client *http.Client, table string, row map[string]any) error {
+	row = merge(map[string]any{"tenant_id": tenantIDFrom(ctx)}, row)
+	if outboxQ != nil {
+		return outboxQ.Enqueue(table, row)
+	}
+	res, err := sbPost(ctx, client, table, row, nil, "return=minimal")
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("%s insert failed: %d", table, res.StatusCode)
+	}
+	return nil
+}
+
+func outboxAdminHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if outboxQ == nil {
+		writeJSON(w, 200, map[string]any{"enabled": false})
+		return
+	}
+	writeJSON(w, 200, merge(map[string]any{"enabled": true, "path": outboxQ.path}, outboxQ.Status()))
+}
+
+// requireAdmin checks the bearer token against ADMIN_TOKEN. Admin endpoints are
+// disabled entirely while ADMIN_TOKEN is unset.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	want := strings.TrimSpace(getConfig().AdminToken)
+	got := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if want == "" {
+		writeJSON(w, 403, map[string]any{"detail": "Admin endpoints are disabled. Set ADMIN_TOKEN."})
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		writeJSON(w, 401, map[string]any{"detail": "unauthorized"})
+		return false
+	}
+	return true
+}
+
+func readBody(res *http.Response) string {
+	if res == nil || res.Body == nil {
+		return ""
+	}
+	b := new(strings.Builder)
+	_, _ = bufio.NewReader(res.Body).WriteTo(b)
+	return b.String()
+}
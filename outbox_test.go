@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOutboxScrub(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	o, err := openOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = o.Enqueue("events", map[string]any{"user_id": "u1", "payload": map[string]any{"email": "jane@example.com"}})
+	_ = o.Enqueue("events", map[string]any{"user_id": "u2", "payload": map[string]any{}})
+	_ = o.Enqueue("llm_usage", map[string]any{"user_id": "u1", "anon_id": "a1", "cost_usd": 0.01})
+	o.ack(o.pending[:1], "rejected") // dead-letters u1's event
+	_ = o.Enqueue("tool_calls", map[string]any{"conversation_id": "c1", "request": map[string]any{"q": "x"}})
+
+	n, err := o.Scrub(func(table string, row map[string]any) (map[string]any, bool) {
+		switch {
+		case table == "llm_usage" && row["user_id"] == "u1":
+			return merge(row, map[string]any{"user_id": nil, "anon_id": nil}), true
+		case row["user_id"] == "u1" || row["conversation_id"] == "c1":
+			return nil, true
+		}
+		return row, false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("matched %d rows, want 3", n)
+	}
+	o.f.Close()
+
+	dead, _ := os.ReadFile(path + ".dead")
+	if strings.TrimSpace(string(dead)) != "" {
+		t.Errorf("dead-letter file still holds %q", dead)
+	}
+	// Reopening reads the rewritten log.
+	o, err = openOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.f.Close()
+	if len(o.pending) != 2 {
+		t.Fatalf("pending = %d rows, want 2", len(o.pending))
+	}
+	if r := o.pending[0].Row; o.pending[0].Table != "events" || r["user_id"] != "u2" {
+		t.Errorf("first row = %s %v, want u2's event", o.pending[0].Table, r)
+	}
+	if r := o.pending[1].Row; o.pending[1].Table != "llm_usage" || r["user_id"] != nil || r["anon_id"] != nil || r["cost_usd"] != 0.01 {
+		t.Errorf("llm_usage row = %v, want it unlinked", r)
+	}
+}
+
+// TestOutboxFlushErrors checks that setup errors keep the queue intact while row-level
+// errors dead-letter only the bad row.
+func TestOutboxFlushErrors(t *testing.T) {
+	fake := newFakeBackend(0, 0)
+	useFakeBackend(t, fake)
+	status := 401
+	fake.Fail = func(r *http.Request) int {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var rows []map[string]any
+		_ = json.Unmarshal(body, &rows)
+		for _, row := range rows {
+			if row["bad"] == true || status == 401 {
+				return status
+			}
+		}
+		return 0
+	}
+	o, err := openOutbox(filepath.Join(t.TempDir(), "outbox.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.f.Close()
+	for i := range 4 {
+		_ = o.Enqueue("events", map[string]any{"n": i, "bad": i == 2})
+	}
+	for range outboxMaxAttempts + 1 {
+		_ = o.flushAll(context.Background())
+	}
+	if o.Depth() != 4 || o.deadLetters != 0 || o.pending[0].attempts != 0 {
+		t.Fatalf("after 401s: depth %d, dead %d, head attempts %d, want 4, 0, 0", o.Depth(), o.deadLetters, o.pending[0].attempts)
+	}
+
+	status = 422
+	for range 3 * outboxMaxAttempts {
+		if o.flushAll(context.Background()) == nil {
+			break
+		}
+	}
+	if o.Depth() != 0 || o.deadLetters != 1 || len(fake.Rows("events")) != 3 {
+		t.Errorf("after 422s: depth %d, dead %d, stored %d, want 0, 1, 3", o.Depth(), o.deadLetters, len(fake.Rows("events")))
+	}
+}
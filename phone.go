@@ -0,0 +1,201 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// callingCode describes a country's numbering plan well enough to normalise and
+// sanity-check numbers: its calling code, the length range of national significant
+// numbers, and the trunk prefix dialled before them domestically.
+type callingCode struct {
+	code     string
+	min, max int
+	trunk    string
+	names    []string // lower-case names and aliases seen in addresses
+}
+
+var callingCodes = map[string]callingCode{
+	"US": {"1", 10, 10, "1", []string{"united states", "united states of america", "usa", "america"}},
+	"CA": {"1", 10, 10, "1", []string{"canada"}},
+	"MX": {"52", 10, 10, "", []string{"mexico"}},
+	"BR": {"55", 10, 11, "0", []string{"brazil", "brasil"}},
+	"AR": {"54", 10, 10, "0", []string{"argentina"}},
+	"CL": {"56", 9, 9, "", []string{"chile"}},
+	"CO": {"57", 10, 10, "", []string{"colombia"}},
+	"PE": {"51", 8, 9, "0", []string{"peru"}},
+	"GB": {"44", 9, 10, "0", []string{"united kingdom", "uk", "great britain", "britain", "england", "scotland", "wales", "northern ireland"}},
+	"IE": {"353", 7, 9, "0", []string{"ireland"}},
+	"FR": {"33", 9, 9, "0", []string{"france"}},
+	"DE": {"49", 6, 13, "0", []string{"germany", "deutschland"}},
+	"ES": {"34", 9, 9, "", []string{"spain", "españa", "espana"}},
+	"IT": {"39", 6, 11, "", []string{"italy", "italia"}},
+	"PT": {"351", 9, 9, "", []string{"portugal"}},
+	"NL": {"31", 9, 9, "0", []string{"netherlands", "the netherlands", "holland"}},
+	"BE": {"32", 8, 9, "0", []string{"belgium"}},
+	"CH": {"41", 9, 9, "0", []string{"switzerland"}},
+	"AT": {"43", 4, 13, "0", []string{"austria"}},
+	"SE": {"46", 7, 9, "0", []string{"sweden"}},
+	"NO": {"47", 8, 8, "", []string{"norway"}},
+	"DK": {"45", 8, 8, "", []string{"denmark"}},
+	"FI": {"358", 5, 12, "0", []string{"finland"}},
+	"PL": {"48", 9, 9, "", []string{"poland"}},
+	"CZ": {"420", 9, 9, "", []string{"czechia", "czech republic"}},
+	"GR": {"30", 10, 10, "", []string{"greece"}},
+	"TR": {"90", 10, 10, "0", []string{"turkey", "türkiye", "turkiye"}},
+	"RU": {"7", 10, 10, "8", []string{"russia"}},
+	"UA": {"380", 9, 9, "0", []string{"ukraine"}},
+	"IL": {"972", 8, 9, "0", []string{"israel"}},
+	"AE": {"971", 8, 9, "0", []string{"united arab emirates", "uae"}},
+	"SA": {"966", 9, 9, "0", []string{"saudi arabia"}},
+	"EG": {"20", 9, 10, "0", []string{"egypt"}},
+	"MA": {"212", 9, 9, "0", []string{"morocco"}},
+	"NG": {"234", 8, 10, "0", []string{"nigeria"}},
+	"KE": {"254", 9, 9, "0", []string{"kenya"}},
+	"ZA": {"27", 9, 9, "0", []string{"south africa"}},
+	"IN": {"91", 10, 10, "0", []string{"india"}},
+	"PK": {"92", 9, 10, "0", []string{"pakistan"}},
+	"CN": {"86", 10, 11, "0", []string{"china"}},
+	"HK": {"852", 8, 8, "", []string{"hong kong"}},
+	"JP": {"81", 9, 10, "0", []string{"japan"}},
+	"KR": {"82", 8, 10, "0", []string{"south korea", "korea"}},
+	"SG": {"65", 8, 8, "", []string{"singapore"}},
+	"MY": {"60", 9, 10, "0", []string{"malaysia"}},
+	"TH": {"66", 8, 9, "0", []string{"thailand"}},
+	"ID": {"62", 9, 12, "0", []string{"indonesia"}},
+	"PH": {"63", 10, 10, "0", []string{"philippines"}},
+	"VN": {"84", 9, 10, "0", []string{"vietnam", "viet nam"}},
+	"AU": {"61", 9, 9, "0", []string{"australia"}},
+	"NZ": {"64", 8, 10, "0", []string{"new zealand"}},
+}
+
+// countriesByCode lists the countries sharing each calling code, in a fixed order so
+// "+1" numbers resolve to US before CA.
+var countriesByCode = func() map[string][]string {
+	out := map[string][]string{}
+	for _, iso := range sortedKeys(callingCodes) {
+		c := callingCodes[iso]
+		if iso == "US" {
+			out[c.code] = append([]string{iso}, out[c.code]...)
+			continue
+		}
+		out[c.code] = append(out[c.code], iso)
+	}
+	return out
+}()
+
+var phoneExtension = regexp.MustCompile(`(?i)\s*(?:ext\.?|extension|x)\s*\d+\s*$`)
+
+// phoneNumber is a parsed phone number. E164 is empty when a national number could
+// not be placed in a country; international numbers outside the bundled plans keep
+// "+digits" with Valid false. Valid reports whether the length fits the country's plan.
+type phoneNumber struct {
+	Raw     string `json:"raw"`
+	E164    string `json:"e164,omitempty"`
+	Country string `json:"country,omitempty"`
+	Valid   bool   `json:"valid"`
+}
+
+// parsePhone normalises raw to E.164. Numbers written with "+" or "00" carry their
+// country; others are read as national numbers of defaultCountry (ISO 3166 alpha-2).
+func parsePhone(raw, defaultCountry string) phoneNumber {
+	p := phoneNumber{Raw: strings.TrimSpace(raw)}
+	// "+44 (0)20 …" repeats the trunk prefix after the country code.
+	s := strings.ReplaceAll(phoneExtension.ReplaceAllString(p.Raw, ""), "(0)", "")
+	digits := onlyDigits(s)
+	international := strings.HasPrefix(s, "+")
+	if !international && strings.HasPrefix(digits, "00") {
+		digits, international = digits[2:], true
+	}
+	if international {
+		for n := 1; n <= 3 && n < len(digits); n++ {
+			for _, iso := range countriesByCode[digits[:n]] {
+				if plausible(iso, digits[n:]) {
+					return phoneNumber{Raw: p.Raw, E164: "+" + digits, Country: iso, Valid: true}
+				}
+			}
+		}
+		if n := len(digits); n >= 7 && n <= 15 {
+			p.E164 = "+" + digits
+		}
+		return p
+	}
+	c, ok := callingCodes[defaultCountry]
+	if !ok {
+		return p
+	}
+	nsn := digits
+	switch {
+	case plausible(defaultCountry, nsn):
+	case c.trunk != "" && strings.HasPrefix(nsn, c.trunk) && plausible(defaultCountry, nsn[len(c.trunk):]):
+		nsn = nsn[len(c.trunk):]
+	case strings.HasPrefix(nsn, c.code) && plausible(defaultCountry, nsn[len(c.code):]):
+		nsn = nsn[len(c.code):]
+	default:
+		return phoneNumber{Raw: p.Raw, Country: defaultCountry}
+	}
+	return phoneNumber{Raw: p.Raw, E164: "+" + c.code + nsn, Country: defaultCountry, Valid: true}
+}
+
+func plausible(iso, nsn string) bool {
+	c := callingCodes[iso]
+	if len(nsn) < c.min || len(nsn) > c.max {
+		return false
+	}
+	// North American area codes never start with 0 or 1.
+	if c.code == "1" {
+		return nsn[0] >= '2'
+	}
+	return nsn[0] != '0' || iso == "IT"
+}
+
+// countryCode maps an ISO code, country name or common alias to an ISO code.
+func countryCode(v string) string {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if v == "" {
+		return ""
+	}
+	if _, ok := callingCodes[strings.ToUpper(v)]; ok {
+		return strings.ToUpper(v)
+	}
+	for _, iso := range sortedKeys(callingCodes) {
+		if containsString(callingCodes[iso].names, v) {
+			return iso
+		}
+	}
+	return ""
+}
+
+// localeCountry returns the region of a locale such as "en-GB" or "pt_BR".
+func localeCountry(locale string) string {
+	_, region, ok := strings.Cut(strings.ReplaceAll(locale, "_", "-"), "-")
+	if !ok {
+		return ""
+	}
+	region, _, _ = strings.Cut(region, "-")
+	return countryCode(region)
+}
+
+// phoneCountry infers the country of national-format numbers from, in order, the
+// address the user gave, the session locale and the tenant's phone.default_country.
+func phoneCountry(extracted map[string]any, locale, fallback string) string {
+	if c := countryCode(asString(mapOf(extracted["address_components"])["country"])); c != "" {
+		return c
+	}
+	if c := localeCountry(locale); c != "" {
+		return c
+	}
+	return countryCode(fallback)
+}
+
+// normalizeExtractedPhone replaces the extracted phone with its E.164 form and records
+// the raw text, country and validity next to it.
+func normalizeExtractedPhone(extracted map[string]any, country string) {
+	raw := asString(extracted["phone"])
+	if strings.TrimSpace(raw) == "" {
+		return
+	}
+	p := parsePhone(raw, country)
+	extracted["phone"] = ternary[any](p.E164 != "", p.E164, nil)
+	extracted["phone_raw"], extracted["phone_country"], extracted["phone_valid"] = p.Raw, p.Country, p.Valid
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestParsePhone(t *testing.T) {
+	cases := []struct {
+		raw, country string
+		want         phoneNumber
+	}{
+		{"(555) 123-4567", "US", phoneNumber{E164: "+15551234567", Country: "US", Valid: true}},
+		{"+1 555 123 4567", "GB", phoneNumber{E164: "+15551234567", Country: "US", Valid: true}},
+		{"07700 900123", "GB", phoneNumber{E164: "+447700900123", Country: "GB", Valid: true}},
+		{"+44 (0)20 7946 0958", "US", phoneNumber{E164: "+442079460958", Country: "GB", Valid: true}},
+		{"0044 20 7946 0958", "US", phoneNumber{E164: "+442079460958", Country: "GB", Valid: true}},
+		{"555-123-4567 ext. 89", "US", phoneNumber{E164: "+15551234567", Country: "US", Valid: true}},
+		{"+886 912 345 678", "US", phoneNumber{E164: "+886912345678"}},
+		{"555 123", "US", phoneNumber{Country: "US"}},
+		{"12345", "XX", phoneNumber{}},
+	}
+	for _, tc := range cases {
+		got := parsePhone(tc.raw, tc.country)
+		tc.want.Raw = tc.raw
+		if got != tc.want {
+			t.Errorf("parsePhone(%q, %s) = %+v, want %+v", tc.raw, tc.country, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Inbound messages are scanned for data the bot must never store or forward: card
+// numbers, card security codes, IBANs, passwords and secrets, and government ids.
+// Matches are replaced before the message reaches the extractor, the chat model or
+// Supabase; only their type and position are recorded.
+
+// piiFinding is one redacted span, as byte offsets into the original message.
+type piiFinding struct {
+	Type  string `json:"type"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+type piiPattern struct {
+	kind  string
+	re    *regexp.Regexp
+	group int // submatch to redact; 0 is the whole match
+	valid func(string) bool
+	fit   func(string) int // length of the leading part to redact; 0 rejects the match
+}
+
+var piiPatterns = []piiPattern{
+	// Numbers written with "+" are phone numbers, not cards.
+	{"card_number", regexp.MustCompile(`(?:^|[^+\w])([2-6](?:[ \-]?\d){12,18})\b`), 1, nil, luhnPrefix},
+	{"cvv", regexp.MustCompile(`(?i)\b(?:cvv2?|cvc2?|cid|csc|security code)\b\D{0,12}?(\d{3,4})\b`), 1, nil, nil},
+	{"iban", regexp.MustCompile(`\b[A-Z]{2}\d{2}(?:[ ]?[A-Z0-9]){11,30}\b`), 0, ibanValid, nil},
+	{"password", regexp.MustCompile(`(?i)\b(?:password|passwd|pwd|passcode|pin)\b\s*(?:is|was|=|:)\s*["']?([^\s"']{3,})`), 1, func(s string) bool { return !passwordStopWords[strings.ToLower(s)] }, nil},
+	{"secret", regexp.MustCompile(`\b(?:sk-[A-Za-z0-9_\-]{20,}|gh[pousr]_[A-Za-z0-9]{36,}|AKIA[0-9A-Z]{16}|xox[abpr]-[A-Za-z0-9\-]{10,})\b`), 0, nil, nil},
+	{"us_ssn", regexp.MustCompile(`\b(\d{3})-(\d{2})-(\d{4})\b`), 0, ssnValid, nil},
+	{"uk_nino", regexp.MustCompile(`(?i)\b[A-CEGHJ-PR-TW-Z][A-CEGHJ-NPR-TW-Z] ?\d{2} ?\d{2} ?\d{2} ?[A-D]\b`), 0, nil, nil},
+	{"es_dni", regexp.MustCompile(`(?i)\b[XYZ]?\d{7,8}-?[A-Z]\b`), 0, dniValid, nil},
+	{"passport", regexp.MustCompile(`(?i)\bpassport(?:\s+(?:number|no\.?|num|#))?\s*(?:is|:|#)?\s*([A-Z0-9]{6,9})\b`), 1, func(s string) bool { return strings.ContainsAny(s, "0123456789") }, nil},
+}
+
+// passwordStopWords are words that follow "password is" without being one.
+var passwordStopWords = map[string]bool{"not": true, "wrong": true, "incorrect": true, "invalid": true, "expired": true, "too": true, "the": true, "my": true, "correct": true, "right": true, "missing": true, "reset": true, "locked": true, "working": true, "forgotten": true}
+
+var piiLabels = map[string]string{
+	"card_number": "a card number", "cvv": "a card security code", "iban": "a bank account number",
+	"password": "a password", "secret": "an access key", "us_ssn": "a Social Security number",
+	"uk_nino": "a National Insurance number", "es_dni": "an ID number", "passport": "a passport number",
+}
+
+var piiRedacted = newCounterVec("chatbot_pii_redacted_total", "Sensitive values removed from inbound messages, by type.", "type")
+
+// redactPII returns text with sensitive values replaced by "[redacted <type>]" and
+// what was found. Overlapping matches keep the one found first in piiPatterns order.
+func redactPII(text string) (string, []piiFinding) {
+	found := []piiFinding{}
+	taken := func(s, e int) bool {
+		for _, f := range found {
+			if s < f.End && e > f.Start {
+				return true
+			}
+		}
+		return false
+	}
+	for _, p := range piiPatterns {
+		for _, m := range p.re.FindAllStringSubmatchIndex(text, -1) {
+			s, e := m[2*p.group], m[2*p.group+1]
+			if s >= 0 && p.fit != nil {
+				e = s + p.fit(text[s:e])
+			}
+			if s < 0 || s == e || taken(s, e) || p.valid != nil && !p.valid(text[s:e]) {
+				continue
+			}
+			found = append(found, piiFinding{Type: p.kind, Start: s, End: e})
+		}
+	}
+	if len(found) == 0 {
+		return text, nil
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Start < found[j].Start })
+	var b strings.Builder
+	last := 0
+	for _, f := range found {
+		b.WriteString(text[last:f.Start])
+		b.WriteString("[redacted " + strings.ReplaceAll(f.Type, "_", " ") + "]")
+		last = f.End
+		piiRedacted.Inc(f.Type)
+	}
+	b.WriteString(text[last:])
+	return b.String(), found
+}
+
+// piiWarning is shown to the user when something was removed from their message.
+func piiWarning(found []piiFinding) string {
+	if len(found) == 0 {
+		return ""
+	}
+	kinds := []string{}
+	for _, f := range found {
+		if l := piiLabels[f.Type]; !containsString(kinds, l) {
+			kinds = append(kinds, l)
+		}
+	}
+	what := kinds[0]
+	if len(kinds) > 1 {
+		what = strings.Join(kinds[:len(kinds)-1], ", ") + " and " + kinds[len(kinds)-1]
+	}
+	return fmt.Sprintf("For your security we removed %s from your message and did not store it. Please don't share payment details, passwords or ID numbers in this chat.", what)
+}
+
+func piiNote(found []piiFinding) string {
+	if len(found) == 0 {
+		return ""
+	}
+	return "The user's message contained sensitive data that was removed (shown as [redacted …]). Do not ask for it again; payment and account details are never needed in this chat."
+}
+
+// luhnPrefix returns the length of the longest leading 13-19 digit part of s that
+// passes the Luhn check, so that "4111 1111 1111 1111 123" (a card number followed
+// by other digits) still finds the card. Parts that end a digit group are tried first.
+func luhnPrefix(s string) int {
+	var grouped, ungrouped []int
+	digits := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			continue
+		}
+		if digits++; digits < 13 || digits > 19 {
+			continue
+		}
+		if i+1 == len(s) || s[i+1] == ' ' || s[i+1] == '-' {
+			grouped = append(grouped, i+1)
+		} else {
+			ungrouped = append(ungrouped, i+1)
+		}
+	}
+	for _, ends := range [][]int{grouped, ungrouped} {
+		for i := len(ends) - 1; i >= 0; i-- {
+			if luhnValid(s[:ends[i]]) {
+				return ends[i]
+			}
+		}
+	}
+	return 0
+}
+
+func luhnValid(s string) bool {
+	d := onlyDigits(s)
+	if len(d) < 13 || len(d) > 19 || strings.Count(d, string(d[0])) == len(d) {
+		return false
+	}
+	sum := 0
+	for i := len(d) - 1; i >= 0; i-- {
+		n := int(d[i] - '0')
+		if (len(d)-i)%2 == 0 {
+			if n *= 2; n > 9 {
+				n -= 9
+			}
+		}
+		sum += n
+	}
+	return sum%10 == 0
+}
+
+// ibanValid checks the ISO 13616 mod-97 checksum.
+func ibanValid(s string) bool {
+	s = strings.ToUpper(strings.ReplaceAll(s, " ", ""))
+	if len(s) < 15 || len(s) > 34 {
+		return false
+	}
+	var b strings.Builder
+	for _, r := range s[4:] + s[:4] {
+		if r >= 'A' && r <= 'Z' {
+			fmt.Fprintf(&b, "%d", r-'A'+10)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	n, ok := new(big.Int).SetString(b.String(), 10)
+	return ok && new(big.Int).Mod(n, big.NewInt(97)).Int64() == 1
+}
+
+// ssnValid rejects numbers the SSA never issues (area 000, 666 or 9xx, group 00,
+// serial 0000).
+func ssnValid(s string) bool {
+	d := onlyDigits(s)
+	return d[:3] != "000" && d[:3] != "666" && d[0] != '9' && d[3:5] != "00" && d[5:] != "0000"
+}
+
+// dniValid checks the control letter of a Spanish DNI or NIE.
+func dniValid(s string) bool {
+	s = strings.ToUpper(strings.ReplaceAll(s, "-", ""))
+	num := strings.NewReplacer("X", "0", "Y", "1", "Z", "2").Replace(s[:len(s)-1])
+	if len(num) != 8 {
+		return false
+	}
+	n := 0
+	for _, r := range num {
+		n = n*10 + int(r-'0')
+	}
+	return "TRWAGMYFPDXBNJZSQVHLCKE"[n%23] == s[len(s)-1]
+}
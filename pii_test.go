@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestRedactPII(t *testing.T) {
+	cases := []struct {
+		text  string
+		want  string
+		types []string
+	}{
+		{"my card is 4111 1111 1111 1111", "my card is [redacted card number]", []string{"card_number"}},
+		{"my card is 4111 1111 1111 1111 123", "my card is [redacted card number] 123", []string{"card_number"}},
+		{"card 4111-1111-1111-1111 cvv 123", "card [redacted card number] cvv [redacted cvv]", []string{"card_number", "cvv"}},
+		{"not a card: 4111 1111 1111 1112", "not a card: 4111 1111 1111 1112", nil},
+		{"call me on +4111111111111111", "call me on +4111111111111111", nil},
+		{"IBAN GB82 WEST 1234 5698 7654 32 please", "IBAN [redacted iban] please", []string{"iban"}},
+		{"my password is hunter22", "my password is [redacted password]", []string{"password"}},
+		{"my password is not working", "my password is not working", nil},
+		{"ssn 123-45-6789", "ssn [redacted us ssn]", []string{"us_ssn"}},
+		{"ssn 000-45-6789", "ssn 000-45-6789", nil},
+		{"key sk-abcdefghijklmnopqrstuvwxyz123456", "key [redacted secret]", []string{"secret"}},
+		{"passport number is X1234567", "passport number is [redacted passport]", []string{"passport"}},
+		{"order #12345 arrived", "order #12345 arrived", nil},
+	}
+	for _, tc := range cases {
+		got, found := redactPII(tc.text)
+		if got != tc.want {
+			t.Errorf("redactPII(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+		types := []string{}
+		for _, f := range found {
+			types = append(types, f.Type)
+			if f.Start < 0 || f.End > len(tc.text) || f.Start >= f.End {
+				t.Errorf("redactPII(%q): bad span %+v", tc.text, f)
+			}
+		}
+		if len(types) != len(tc.types) {
+			t.Errorf("redactPII(%q) found %v, want %v", tc.text, types, tc.types)
+			continue
+		}
+		for i := range types {
+			if types[i] != tc.types[i] {
+				t.Errorf("redactPII(%q) found %v, want %v", tc.text, types, tc.types)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Model preferences are stored as "preferred_model" in conversations.metadata and
+// app_users.profile. The model for a turn is the first available one of: the request's
+// model, the conversation's, the user's, the tenant default.
+const (
+	modelSourceRequest      = "request"
+	modelSourceConversation = "conversation"
+	modelSourceUser         = "user"
+	modelSourceTenant       = "tenant_default"
+)
+
+var errModelNotAllowed = errors.New("model is not available")
+
+// resolveModel picks the model for a turn. requested has already been checked.
+func resolveModel(ctx context.Context, requested string, convMeta, profile map[string]any) (model, source string) {
+	if requested != "" {
+		return requested, modelSourceRequest
+	}
+	for _, c := range []struct {
+		model, source string
+	}{{asString(convMeta["preferred_model"]), modelSourceConversation}, {asString(profile["preferred_model"]), modelSourceUser}} {
+		if c.model == "" {
+			continue
+		}
+		if modelAllowed(ctx, c.model) {
+			return c.model, c.source
+		}
+		logFrom(ctx).Warn("stored model preference is no longer available", "model", c.model, "level", c.source)
+	}
+	return configFor(ctx).PreferredModel, modelSourceTenant
+}
+
+// setModelPreference stores model on the user's profile or, when conversationID is set,
+// on that conversation's metadata. An empty model clears the preference.
+func setModelPreference(ctx context.Context, client *http.Client, user map[string]any, conversationID, model string) error {
+	userID := asString(user["id"])
+	if conversationID == "" {
+		profile := mapOf(user["profile"])
+		profile["preferred_model"] = ternary[any](model != "", model, nil)
+		res, err := sbPatch(ctx, client, "app_users", map[string]any{"profile": profile, "last_seen_at": isoNow()}, map[string]string{"id": "eq." + userID}, "return=minimal")
+		return sbWriteErr("app_users", res, err)
+	}
+	res, err := sbGet(ctx, client, "conversations", map[string]string{"select": "id,user_id,metadata", "id": "eq." + conversationID, "limit": "1"})
+	if err != nil {
+		return err
+	}
+	rows := toSliceMap(res)
+	if len(rows) == 0 || asString(rows[0]["user_id"]) != userID {
+		return errConversationNotFound
+	}
+	meta := mapOf(rows[0]["metadata"])
+	meta["preferred_model"] = ternary[any](model != "", model, nil)
+	res, err = sbPatch(ctx, client, "conversations", map[string]any{"metadata": meta, "updated_at": isoNow()}, map[string]string{"id": "eq." + conversationID}, "return=minimal")
+	return sbWriteErr("conversations", res, err)
+}
+
+var errConversationNotFound = errors.New("Conversation not found for this user.")
+
+// loadConversation returns the conversation's owner, metadata and locale, or an empty map.
+func loadConversation(ctx context.Context, client *http.Client, conversationID string) map[string]any {
+	res, err := sbGet(ctx, client, "conversations", map[string]string{"select": "user_id,metadata,locale", "id": "eq." + conversationID, "limit": "1"})
+	if err != nil {
+		return map[string]any{}
+	}
+	rows := toSliceMap(res)
+	if len(rows) == 0 {
+		return map[string]any{}
+	}
+	return rows[0]
+}
+
+// modelPreferenceHandler serves POST /v1/config: {"preferred_model", "conversation_id"}.
+// It only changes the caller's preference; the tenant default is set through
+// /v1/admin/config.
+func modelPreferenceHandler(w http.ResponseWriter, r *http.Request, in ConfigIn) {
+	model := strings.TrimSpace(in.PreferredModel)
+	ctx := r.Context()
+	if model != "" && !modelAllowed(ctx, model) {
+		writeJSON(w, 400, map[string]any{"detail": fmt.Sprintf("%s: %q", errModelNotAllowed, model)})
+		return
+	}
+	anon := getOrSetAnonID(w, r)
+	client := &http.Client{Timeout: 30 * time.Second}
+	user, err := ensureAppUserForAnon(ctx, client, anon)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	if err := setModelPreference(ctx, client, user, in.ConversationID, model); err != nil {
+		if errors.Is(err, errConversationNotFound) {
+			writeJSON(w, 404, map[string]any{"detail": err.Error()})
+			return
+		}
+		writeErr(w, err)
+		return
+	}
+	scope := ternary(in.ConversationID != "", modelSourceConversation, modelSourceUser)
+	_ = sbInsertEvent(ctx, client, asString(user["id"]), in.ConversationID, "model_preference_set", "backend", map[string]any{"anon_id": anon, "scope": scope, "model": ternary[any](model != "", model, nil)})
+	writeJSON(w, 200, map[string]any{"ok": true, "scope": scope, "preferred_model": model, "conversation_id": in.ConversationID, "config": maskConfig(configFor(ctx)), "tenant": tenantInfo(ctx)})
+}
+
+func sbWriteErr(table string, res *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("%s update failed: %d %s", table, res.StatusCode, truncate(readBody(res), 300))
+	}
+	return nil
+}
+
+// mapOf returns a copy of v when it is a JSON object (decoded or raw), else an empty map.
+func mapOf(v any) map[string]any {
+	switch m := v.(type) {
+	case map[string]any:
+		return merge(nil, m)
+	case string:
+		out := map[string]any{}
+		_ = json.Unmarshal([]byte(m), &out)
+		return out
+	}
+	return map[string]any{}
+}
@@ -0,0 +1,667 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Data subject requests export or erase everything stored about a person. Visitors
+// prove they own an email address with a one-time code (/v1/privacy/request, then
+// /v1/privacy/verify); operators who verified the requester some other way use
+// `go run . privacy`. Every completed request records a privacy.export or
+// privacy.erasure event without a user_id, so the record outlives the erasure.
+
+// privacyTables holds a user's data, children first: the order rows are erased in.
+var privacyTables = []string{"tool_calls", "messages", "events", "llm_usage", "user_addresses", "identity_keys", "user_sessions", "conversations", "app_users"}
+
+const (
+	privacyCodeTTL     = 15 * time.Minute
+	privacyMaxAttempts = 5
+)
+
+// Code requests send email, so they are throttled per subject (tenant and email)
+// and per client address, in memory.
+var (
+	privacySubjectLimit = &windowLimiter{max: 3, window: time.Hour}
+	privacyIPLimit      = &windowLimiter{max: 10, window: time.Hour}
+)
+
+// windowLimiter allows max hits per key in any window.
+type windowLimiter struct {
+	max    int
+	window time.Duration
+
+	mu   sync.Mutex
+	hits map[string][]time.Time
+}
+
+// allow records a hit for key unless it is over the limit, in which case it returns
+// how long until the next hit is allowed.
+func (l *windowLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.hits == nil {
+		l.hits = map[string][]time.Time{}
+	}
+	prune := func(ts []time.Time) []time.Time {
+		for len(ts) > 0 && now.Sub(ts[0]) >= l.window {
+			ts = ts[1:]
+		}
+		return ts
+	}
+	if len(l.hits) >= 10000 {
+		for k, ts := range l.hits {
+			if ts = prune(ts); len(ts) == 0 {
+				delete(l.hits, k)
+			} else {
+				l.hits[k] = ts
+			}
+		}
+	}
+	ts := prune(l.hits[key])
+	if len(ts) >= l.max {
+		l.hits[key] = ts
+		return false, ts[0].Add(l.window).Sub(now)
+	}
+	l.hits[key] = append(ts, now)
+	return true, 0
+}
+
+type PrivacyRequestIn struct {
+	Action string `json:"action"`
+	Email  string `json:"email"`
+	Mode   string `json:"mode"`
+}
+
+type PrivacyVerifyIn struct {
+	RequestID string `json:"request_id"`
+	Code      string `json:"code"`
+	Format    string `json:"format"`
+}
+
+// privacySubject names a person by any identifier stored for them.
+type privacySubject struct {
+	Email, Phone, AnonID, UserID string
+}
+
+// hash identifies the subject in audit rows without storing the identifiers.
+func (s privacySubject) hash(ctx context.Context) string {
+	email := ternary(s.Email != "", analyzeEmail(s.Email, configFor(ctx)).Canonical, "")
+	h := sha256.Sum256([]byte(strings.Join([]string{tenantIDFrom(ctx), ternary(email != "", email, normalizeEmail(s.Email)), onlyDigits(s.Phone), s.AnonID, s.UserID}, "|")))
+	return hex.EncodeToString(h[:])
+}
+
+// resolveSubject returns the ids of the app_users s refers to: by id, anonymous id,
+// stored email or phone, and the email/phone identity keys.
+func resolveSubject(ctx context.Context, client *http.Client, s privacySubject) ([]string, error) {
+	type lookup struct {
+		table, col string
+		params     map[string]string
+	}
+	c := configFor(ctx)
+	var ls []lookup
+	if s.UserID != "" {
+		ls = append(ls, lookup{"app_users", "id", map[string]string{"id": "eq." + s.UserID}})
+	}
+	if s.AnonID != "" {
+		ls = append(ls, lookup{"app_users", "id", map[string]string{"anonymous_id": "eq." + s.AnonID}})
+	}
+	if s.Email != "" {
+		ls = append(ls, lookup{"app_users", "id", map[string]string{"email": "eq." + normalizeEmail(s.Email)}})
+		if v := analyzeEmail(s.Email, c).Canonical; v != "" {
+			ls = append(ls, lookup{"identity_keys", "user_id", map[string]string{"key_type": "eq.email", "key_value": "eq." + v}})
+		}
+	}
+	if v := parsePhone(s.Phone, c.PhoneDefaultCountry).E164; s.Phone != "" && v != "" {
+		ls = append(ls, lookup{"app_users", "id", map[string]string{"phone": "eq." + v}}, lookup{"identity_keys", "user_id", map[string]string{"key_type": "eq.phone", "key_value": "eq." + v}})
+	}
+	ids := []string{}
+	for _, l := range ls {
+		l.params["select"] = l.col
+		rows, err := sbGetAll(ctx, client, l.table, l.params)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			if id := asString(row[l.col]); id != "" && !containsString(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// sbGetAll reads every row matching params, a page at a time.
+func sbGetAll(ctx context.Context, client *http.Client, table string, params map[string]string) ([]map[string]any, error) {
+	const page = 1000
+	out := []map[string]any{}
+	for offset := 0; ; offset += page {
+		p := map[string]string{"order": "id.asc", "limit": strconv.Itoa(page), "offset": strconv.Itoa(offset)}
+		for k, v := range params {
+			p[k] = v
+		}
+		res, err := sbGet(ctx, client, table, p)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode >= 400 {
+			return nil, fmt.Errorf("%s read failed: %d %s", table, res.StatusCode, truncate(readBody(res), 300))
+		}
+		rows := toSliceMap(res)
+		out = append(out, rows...)
+		if len(rows) < page {
+			return out, nil
+		}
+	}
+}
+
+func sbDelete(ctx context.Context, client *http.Client, path string, params map[string]string) (*http.Response, error) {
+	return sbDo(ctx, client, http.MethodDelete, path, nil, params, "return=minimal")
+}
+
+// inChunks calls fn with in.() filters of at most 100 values, to keep URLs short.
+func inChunks(vals []string, fn func(filter string) error) error {
+	for i := 0; i < len(vals); i += 100 {
+		if err := fn("in.(" + strings.Join(vals[i:min(i+100, len(vals))], ",") + ")"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func columnValues(rows []map[string]any, col string) []string {
+	out := []string{}
+	for _, row := range rows {
+		if v := asString(row[col]); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// collectUserData reads every row of privacyTables tied to userIDs.
+func collectUserData(ctx context.Context, client *http.Client, userIDs []string) (map[string][]map[string]any, error) {
+	data := map[string][]map[string]any{}
+	for _, t := range privacyTables {
+		data[t] = []map[string]any{}
+	}
+	get := func(table, col string, vals []string) error {
+		return inChunks(vals, func(filter string) error {
+			rows, err := sbGetAll(ctx, client, table, map[string]string{"select": "*", col: filter})
+			data[table] = append(data[table], rows...)
+			return err
+		})
+	}
+	if err := get("app_users", "id", userIDs); err != nil {
+		return nil, err
+	}
+	for _, t := range []string{"identity_keys", "user_sessions", "conversations", "events", "llm_usage", "user_addresses"} {
+		if err := get(t, "user_id", userIDs); err != nil {
+			return nil, err
+		}
+	}
+	convIDs := columnValues(data["conversations"], "id")
+	for _, t := range []string{"messages", "tool_calls"} {
+		if err := get(t, "conversation_id", convIDs); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func rowCounts(data map[string][]map[string]any) map[string]int {
+	counts := map[string]int{}
+	for t, rows := range data {
+		counts[t] = len(rows)
+	}
+	return counts
+}
+
+// eraseUserData deletes or pseudonymizes the rows collectUserData finds and returns
+// how many rows of each table it touched. "delete" removes them, keeping llm_usage
+// rows unlinked for spend accounting; "pseudonymize" blanks names, contact details,
+// message text and payloads but keeps the rows and their ids for analytics.
+func eraseUserData(ctx context.Context, client *http.Client, userIDs []string, mode string) (map[string]int, error) {
+	// Rows still being written in the background would land after the erase.
+	waitBackgroundStarted()
+	data, err := collectUserData(ctx, client, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	convIDs := columnValues(data["conversations"], "id")
+	type step struct {
+		table, col string
+		vals       []string
+		patch      map[string]any // nil deletes
+	}
+	steps := []step{
+		{"tool_calls", "conversation_id", convIDs, nil},
+		{"messages", "conversation_id", convIDs, nil},
+		{"events", "user_id", userIDs, nil},
+		{"llm_usage", "user_id", userIDs, map[string]any{"user_id": nil, "conversation_id": nil, "anon_id": nil}},
+		{"user_addresses", "user_id", userIDs, nil},
+		{"identity_keys", "user_id", userIDs, nil},
+		{"user_sessions", "user_id", userIDs, nil},
+		{"conversations", "user_id", userIDs, nil},
+		{"app_users", "id", userIDs, nil},
+	}
+	if mode == "pseudonymize" {
+		steps = []step{
+			{"tool_calls", "conversation_id", convIDs, map[string]any{"request": map[string]any{}, "response": map[string]any{}}},
+			{"messages", "conversation_id", convIDs, map[string]any{"content": "[erased]", "payload": map[string]any{}}},
+			{"events", "user_id", userIDs, map[string]any{"payload": map[string]any{}}},
+			{"llm_usage", "user_id", userIDs, map[string]any{"anon_id": nil}},
+			{"user_addresses", "user_id", userIDs, nil},
+			{"identity_keys", "user_id", userIDs, nil},
+			{"user_sessions", "user_id", userIDs, map[string]any{"metadata": map[string]any{}}},
+			{"conversations", "user_id", userIDs, map[string]any{"metadata": map[string]any{}}},
+		}
+		// anonymous_id is unique per tenant, so each user gets its own placeholder.
+		for _, id := range userIDs {
+			steps = append(steps, step{"app_users", "id", []string{id}, map[string]any{"name": nil, "email": nil, "phone": nil, "primary_identifier": "erased", "anonymous_id": "erased-" + id, "identity_status": "erased", "identity_tier": 0, "confidence_score": 0, "profile": map[string]any{}, "external_ids": map[string]any{}, "last_seen_at": isoNow()}})
+		}
+	}
+	// Queued and dead-lettered audit rows get the same treatment before the erase,
+	// or the flusher would write them back afterwards.
+	counts := rowCounts(data)
+	if outboxQ != nil {
+		n, err := outboxQ.Scrub(func(table string, row map[string]any) (map[string]any, bool) {
+			for _, s := range steps {
+				if s.table == table && containsString(s.vals, asString(row[s.col])) {
+					return ternary(s.patch == nil, nil, merge(row, s.patch)), true
+				}
+			}
+			return row, false
+		})
+		if err != nil {
+			return nil, fmt.Errorf("outbox scrub: %w", err)
+		}
+		counts["outbox"] = n
+	}
+	for _, s := range steps {
+		err := inChunks(s.vals, func(filter string) error {
+			var res *http.Response
+			var err error
+			if s.patch == nil {
+				res, err = sbDelete(ctx, client, s.table, map[string]string{s.col: filter})
+			} else {
+				res, err = sbPatch(ctx, client, s.table, s.patch, map[string]string{s.col: filter}, "return=minimal")
+			}
+			return sbWriteErr(s.table, res, err)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+// privacyAudit records a completed request. The row has no user_id, so erasing the
+// user does not erase it; the subject is kept only as a hash.
+func privacyAudit(ctx context.Context, client *http.Client, eventType, source, subjectHash string, userIDs []string, extra map[string]any) error {
+	payload := merge(map[string]any{"request_id": requestIDFrom(ctx), "subject_hash": subjectHash, "user_ids": userIDs}, extra)
+	return writeAudit(ctx, client, "events", map[string]any{"user_id": nil, "conversation_id": nil, "event_type": eventType, "source": source, "payload": payload})
+}
+
+func privacyBundle(ctx context.Context, userIDs []string, data map[string][]map[string]any) map[string]any {
+	return map[string]any{"exported_at": isoNow(), "tenant_id": tenantIDFrom(ctx), "user_ids": userIDs, "tables": data}
+}
+
+// writeBundleZip writes bundle as manifest.json plus one <table>.json per table.
+func writeBundleZip(w io.Writer, bundle map[string]any) error {
+	tables, _ := bundle["tables"].(map[string][]map[string]any)
+	files := map[string]any{"manifest.json": map[string]any{"exported_at": bundle["exported_at"], "tenant_id": bundle["tenant_id"], "user_ids": bundle["user_ids"], "counts": rowCounts(tables)}}
+	for t, rows := range tables {
+		files[t+".json"] = rows
+	}
+	zw := zip.NewWriter(w)
+	for _, name := range sortedKeys(files) {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(files[name]); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func privacyCodeHash(subjectHash, code string) string {
+	h := sha256.Sum256([]byte(subjectHash + ":" + code))
+	return hex.EncodeToString(h[:])
+}
+
+// sendPrivacyCode emails code through the tenant's Brevo account.
+func sendPrivacyCode(ctx context.Context, client *http.Client, brevo map[string]string, to, action, code string) error {
+	t, _ := tenantFrom(ctx)
+	sender := map[string]any{"email": brevo["sender_email"]}
+	if n := ternary(brevo["sender_name"] != "", brevo["sender_name"], t.Name); n != "" {
+		sender["name"] = n
+	}
+	text := fmt.Sprintf("Your code to confirm your data %s request is %s. It expires in %d minutes.\n\nIf you didn't ask for this, you can ignore this email.", action, code, int(privacyCodeTTL.Minutes()))
+	j, _ := json.Marshal(map[string]any{"sender": sender, "to": []map[string]any{{"email": to}}, "subject": "Your verification code", "textContent": text})
+	base := ternary(brevo["base_url"] != "", brevo["base_url"], "https://api.brevo.com")
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(base, "/")+"/v3/smtp/email", bytes.NewReader(j))
+	req.Header.Set("api-key", brevo["api_key"])
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	res, body, err := doReqWithClient(client, req)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("brevo send failed: %d %s", res.StatusCode, truncate(string(body), 300))
+	}
+	return nil
+}
+
+// privacyRequestHandler starts an export or erasure for the owner of an email address
+// (and the visitor's own anonymous data) by emailing them a code. The reply is the
+// same whether or not anything is stored for the address.
+func privacyRequestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, 405, map[string]any{"detail": "method not allowed"})
+		return
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if ok, wait := privacyIPLimit.allow(ip, time.Now()); !ok {
+		writeTooManyPrivacyRequests(w, wait)
+		return
+	}
+	var in PrivacyRequestIn
+	_ = json.NewDecoder(r.Body).Decode(&in)
+	ctx := r.Context()
+	in.Mode = ternary(in.Mode != "", in.Mode, "delete")
+	if in.Action != "export" && in.Action != "erase" {
+		writeJSON(w, 400, map[string]any{"detail": "action must be export or erase"})
+		return
+	}
+	if in.Mode != "delete" && in.Mode != "pseudonymize" {
+		writeJSON(w, 400, map[string]any{"detail": "mode must be delete or pseudonymize"})
+		return
+	}
+	if !analyzeEmail(in.Email, configFor(ctx)).Valid {
+		writeJSON(w, 400, map[string]any{"detail": "a valid email address is required"})
+		return
+	}
+	brevo, ok := integrationFor(ctx, "brevo")
+	if !ok || brevo["api_key"] == "" || brevo["sender_email"] == "" {
+		writeJSON(w, 503, map[string]any{"detail": "Email verification is not set up for this store. Please contact support to make this request."})
+		return
+	}
+	if ok, wait := privacySubjectLimit.allow(privacySubject{Email: in.Email}.hash(ctx), time.Now()); !ok {
+		writeTooManyPrivacyRequests(w, wait)
+		return
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	s := privacySubject{Email: in.Email}
+	if c, err := r.Cookie(anonCookie); err == nil {
+		s.AnonID = c.Value
+	}
+	ids, err := resolveSubject(ctx, client, s)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+	expires := time.Now().Add(privacyCodeTTL)
+	subject := s.hash(ctx)
+	res, err := sbPost(ctx, client, "privacy_requests", map[string]any{"action": in.Action, "mode": in.Mode, "subject_hash": subject, "user_ids": ids, "code_hash": privacyCodeHash(subject, code), "status": "pending", "attempts": 0, "expires_at": isoTime(expires)}, nil, "return=representation")
+	if err = sbWriteErr("privacy_requests", res, err); err != nil {
+		writeErr(w, err)
+		return
+	}
+	rows := toSliceMap(res)
+	if len(rows) == 0 {
+		writeErr(w, errors.New("privacy_requests insert returned no row"))
+		return
+	}
+	if err := sendPrivacyCode(ctx, client, brevo, normalizeEmail(in.Email), in.Action, code); err != nil {
+		writeErr(w, err)
+		return
+	}
+	writeJSON(w, 202, map[string]any{"request_id": rows[0]["id"], "expires_at": isoTime(expires)})
+}
+
+func writeTooManyPrivacyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	writeJSON(w, 429, map[string]any{"detail": "Too many requests. Please try again later."})
+}
+
+// privacyVerifyHandler checks the emailed code and carries out the request: the export
+// is returned as JSON or a ZIP, an erasure as row counts.
+func privacyVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, 405, map[string]any{"detail": "method not allowed"})
+		return
+	}
+	var in PrivacyVerifyIn
+	_ = json.NewDecoder(r.Body).Decode(&in)
+	ctx := r.Context()
+	client := &http.Client{Timeout: 120 * time.Second}
+	in.Format = ternary(in.Format != "", in.Format, "json")
+	if in.Format != "json" && in.Format != "zip" {
+		writeJSON(w, 400, map[string]any{"detail": "format must be json or zip"})
+		return
+	}
+	res, err := sbGet(ctx, client, "privacy_requests", map[string]string{"select": "*", "id": "eq." + in.RequestID, "limit": "1"})
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	rows := toSliceMap(res)
+	if len(rows) == 0 || asString(rows[0]["status"]) != "pending" {
+		writeJSON(w, 404, map[string]any{"detail": "No pending request with this id."})
+		return
+	}
+	pr := rows[0]
+	subject := asString(pr["subject_hash"])
+	if exp, err := time.Parse(time.RFC3339, asString(pr["expires_at"])); err != nil || time.Now().After(exp) {
+		_, _ = sbPatch(ctx, client, "privacy_requests", map[string]any{"status": "expired", "code_hash": nil}, map[string]string{"id": "eq." + in.RequestID}, "return=minimal")
+		writeJSON(w, 410, map[string]any{"detail": "This code has expired. Please start a new request."})
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(privacyCodeHash(subject, strings.TrimSpace(in.Code))), []byte(asString(pr["code_hash"]))) != 1 {
+		attempts := toInt(pr["attempts"]) + 1
+		patch := map[string]any{"attempts": attempts}
+		if attempts >= privacyMaxAttempts {
+			patch["status"], patch["code_hash"] = "failed", nil
+		}
+		_, _ = sbPatch(ctx, client, "privacy_requests", patch, map[string]string{"id": "eq." + in.RequestID, "status": "eq.pending"}, "return=minimal")
+		writeJSON(w, 401, map[string]any{"detail": "That code is not correct.", "attempts_left": max(privacyMaxAttempts-attempts, 0)})
+		return
+	}
+	// Claim the request before acting so a code cannot be used twice. It stays
+	// processing until the work is done, and is marked failed if it cannot be.
+	res, err = sbPatch(ctx, client, "privacy_requests", map[string]any{"status": "processing", "code_hash": nil}, map[string]string{"id": "eq." + in.RequestID, "status": "eq.pending"}, "return=representation")
+	if err = sbWriteErr("privacy_requests", res, err); err != nil {
+		writeErr(w, err)
+		return
+	}
+	if len(toSliceMap(res)) == 0 {
+		writeJSON(w, 404, map[string]any{"detail": "No pending request with this id."})
+		return
+	}
+	finish := func(status string) error {
+		patch := map[string]any{"status": status, "completed_at": ternary[any](status == "completed", isoNow(), nil)}
+		res, err := sbPatch(context.WithoutCancel(ctx), client, "privacy_requests", patch, map[string]string{"id": "eq." + in.RequestID, "status": "eq.processing"}, "return=minimal")
+		return sbWriteErr("privacy_requests", res, err)
+	}
+	fail := func(err error) {
+		logFrom(ctx).Error("privacy request failed", "privacy_request_id", in.RequestID, "error", err.Error())
+		_ = finish("failed")
+		writeErr(w, err)
+	}
+	ids := []string{}
+	if vs, ok := pr["user_ids"].([]any); ok {
+		for _, v := range vs {
+			ids = append(ids, asString(v))
+		}
+	}
+	audit := map[string]any{"privacy_request_id": in.RequestID}
+	if asString(pr["action"]) == "erase" {
+		mode := asString(pr["mode"])
+		counts, err := eraseUserData(ctx, client, ids, mode)
+		if err == nil {
+			err = finish("completed")
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+		_ = privacyAudit(ctx, client, "privacy.erasure", "api", subject, ids, merge(audit, map[string]any{"mode": mode, "counts": counts}))
+		http.SetCookie(w, &http.Cookie{Name: anonCookie, Value: "", MaxAge: -1, Path: "/"})
+		writeJSON(w, 200, map[string]any{"erased": counts, "mode": mode})
+		return
+	}
+	data, err := collectUserData(ctx, client, ids)
+	if err != nil {
+		fail(err)
+		return
+	}
+	bundle := privacyBundle(ctx, ids, data)
+	var buf bytes.Buffer
+	if in.Format == "zip" {
+		err = writeBundleZip(&buf, bundle)
+	}
+	if err == nil {
+		err = finish("completed")
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+	_ = privacyAudit(ctx, client, "privacy.export", "api", subject, ids, merge(audit, map[string]any{"format": in.Format, "counts": rowCounts(data)}))
+	if in.Format == "json" {
+		writeJSON(w, 200, bundle)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "data-export-"+in.RequestID+".zip"))
+	_, _ = w.Write(buf.Bytes())
+}
+
+// runPrivacy exports or erases a subject's data for an operator:
+//
+//	go run . privacy export -email jane@example.com -format zip -o jane.zip
+//	go run . privacy erase -anon <cookie> -mode pseudonymize -yes
+func runPrivacy(args []string) error {
+	if len(args) == 0 || (args[0] != "export" && args[0] != "erase") {
+		return errors.New("usage: privacy export|erase [-tenant id] -email|-phone|-anon|-user value [flags]")
+	}
+	action := args[0]
+	fs := flag.NewFlagSet("privacy "+action, flag.ContinueOnError)
+	tenant := fs.String("tenant", defaultTenantID, "tenant id")
+	var s privacySubject
+	fs.StringVar(&s.Email, "email", "", "subject's email address")
+	fs.StringVar(&s.Phone, "phone", "", "subject's phone number")
+	fs.StringVar(&s.AnonID, "anon", "", "subject's anonymous cookie id")
+	fs.StringVar(&s.UserID, "user", "", "subject's app_users id")
+	format := fs.String("format", "json", "export format: json or zip")
+	out := fs.String("o", "", "write the export to this file instead of stdout")
+	mode := fs.String("mode", "delete", "erasure mode: delete or pseudonymize")
+	yes := fs.Bool("yes", false, "carry out the erasure; without it the counts are only shown")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if s == (privacySubject{}) {
+		return errors.New("one of -email, -phone, -anon or -user is required")
+	}
+	if *format != "json" && *format != "zip" {
+		return errors.New("-format must be json or zip")
+	}
+	if *mode != "delete" && *mode != "pseudonymize" {
+		return errors.New("-mode must be delete or pseudonymize")
+	}
+	c, err := loadConfig(defaultConfigSources(), nil)
+	if err != nil {
+		return err
+	}
+	c.LogLevel = "warn"
+	logger = newLogger(c.LogFormat, c.LogLevel)
+	setConfig(c)
+	ctx := withTenant(context.Background(), tenantByID(*tenant))
+	client := &http.Client{Timeout: 120 * time.Second}
+	ids, err := resolveSubject(ctx, client, s)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return errors.New("no user matches")
+	}
+	if action == "erase" {
+		if !*yes {
+			data, err := collectUserData(ctx, client, ids)
+			if err != nil {
+				return err
+			}
+			j, _ := json.MarshalIndent(map[string]any{"user_ids": ids, "rows": rowCounts(data)}, "", "  ")
+			fmt.Println(string(j))
+			return errors.New("nothing erased; re-run with -yes to erase these rows")
+		}
+		counts, err := eraseUserData(ctx, client, ids, *mode)
+		if err != nil {
+			return err
+		}
+		if err := privacyAudit(ctx, client, "privacy.erasure", "cli", s.hash(ctx), ids, map[string]any{"mode": *mode, "counts": counts}); err != nil {
+			return err
+		}
+		j, _ := json.MarshalIndent(map[string]any{"user_ids": ids, "mode": *mode, "erased": counts}, "", "  ")
+		fmt.Println(string(j))
+		return nil
+	}
+	data, err := collectUserData(ctx, client, ids)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	bundle := privacyBundle(ctx, ids, data)
+	if *format == "zip" {
+		err = writeBundleZip(&buf, bundle)
+	} else {
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(bundle)
+	}
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(buf.Bytes())
+	} else {
+		err = os.WriteFile(*out, buf.Bytes(), 0o600)
+	}
+	if err != nil {
+		return err
+	}
+	return privacyAudit(ctx, client, "privacy.export", "cli", s.hash(ctx), ids, map[string]any{"format": *format, "counts": rowCounts(data)})
+}
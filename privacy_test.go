@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPrivacyVerifyStatus checks that a request is only marked completed once the
+// erasure went through, and failed, without an audit event, when it did not.
+func TestPrivacyVerifyStatus(t *testing.T) {
+	fake := newFakeBackend(0, 0)
+	useFakeBackend(t, fake)
+	failEvents := true
+	fake.Fail = func(r *http.Request) int {
+		return ternary(failEvents && r.Method == http.MethodDelete && strings.HasSuffix(r.URL.Path, "/events"), 500, 0)
+	}
+	fake.tables["app_users"] = []map[string]any{{"id": "u1", "tenant_id": defaultTenantID}}
+	fake.tables["events"] = []map[string]any{{"id": "e1", "tenant_id": defaultTenantID, "user_id": "u1"}}
+	for _, id := range []string{"pr1", "pr2"} {
+		fake.tables["privacy_requests"] = append(fake.tables["privacy_requests"], map[string]any{"id": id, "tenant_id": defaultTenantID, "action": "erase", "mode": "delete", "subject_hash": "s", "user_ids": []any{"u1"}, "code_hash": privacyCodeHash("s", "123456"), "status": "pending", "attempts": 0, "expires_at": isoTime(time.Now().Add(time.Minute))})
+	}
+	verify := func(id string) int {
+		rec := httptest.NewRecorder()
+		privacyVerifyHandler(rec, httptest.NewRequest(http.MethodPost, "/v1/privacy/verify", strings.NewReader(`{"request_id":"`+id+`","code":"123456"}`)))
+		return rec.Code
+	}
+	status := func(id string) map[string]any {
+		for _, row := range fake.Rows("privacy_requests") {
+			if row["id"] == id {
+				return row
+			}
+		}
+		return nil
+	}
+	erasures := func() (n int) {
+		for _, e := range fake.Rows("events") {
+			n += ternary(e["event_type"] == "privacy.erasure", 1, 0)
+		}
+		return n
+	}
+
+	if code := verify("pr1"); code < 500 {
+		t.Fatalf("failed erasure answered %d", code)
+	}
+	if pr := status("pr1"); pr["status"] != "failed" || pr["completed_at"] != nil {
+		t.Errorf("failed erasure left status %v, completed_at %v", pr["status"], pr["completed_at"])
+	}
+	if n := erasures(); n != 0 {
+		t.Errorf("failed erasure recorded %d privacy.erasure events", n)
+	}
+
+	failEvents = false
+	if code := verify("pr2"); code != 200 {
+		t.Fatalf("erasure answered %d", code)
+	}
+	if pr := status("pr2"); pr["status"] != "completed" || pr["completed_at"] == nil {
+		t.Errorf("erasure left status %v, completed_at %v", pr["status"], pr["completed_at"])
+	}
+	if n := erasures(); n != 1 {
+		t.Errorf("erasure recorded %d privacy.erasure events, want 1", n)
+	}
+	if code := verify("pr2"); code != 404 {
+		t.Errorf("reusing the code answered %d, want 404", code)
+	}
+}
+
+func TestWindowLimiter(t *testing.T) {
+	l := &windowLimiter{max: 2, window: time.Hour}
+	now := time.Now()
+	for i, want := range []bool{true, true, false} {
+		if ok, _ := l.allow("a", now.Add(time.Duration(i)*time.Minute)); ok != want {
+			t.Errorf("hit %d allowed = %v, want %v", i+1, ok, want)
+		}
+	}
+	if ok, _ := l.allow("b", now); !ok {
+		t.Error("another key was throttled")
+	}
+	if ok, wait := l.allow("a", now.Add(30*time.Minute)); ok || wait != 30*time.Minute {
+		t.Errorf("allowed = %v, wait = %v, want throttled for 30m", ok, wait)
+	}
+	if ok, _ := l.allow("a", now.Add(time.Hour)); !ok {
+		t.Error("key still throttled after the window")
+	}
+}
+
+func TestPrivacyRequestRateLimit(t *testing.T) {
+	prev := privacyIPLimit
+	privacyIPLimit = &windowLimiter{max: 2, window: time.Hour}
+	t.Cleanup(func() { privacyIPLimit = prev })
+	codes := []int{}
+	for range 3 {
+		req := httptest.NewRequest(http.MethodPost, "/v1/privacy/request", strings.NewReader(`{"action":"nope"}`))
+		rec := httptest.NewRecorder()
+		privacyRequestHandler(rec, req)
+		codes = append(codes, rec.Code)
+	}
+	if codes[0] != 400 || codes[1] != 400 || codes[2] != 429 {
+		t.Errorf("statuses = %v, want [400 400 429]", codes)
+	}
+}
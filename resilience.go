@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Retry and circuit-breaker layer applied to every outbound call in doReqWithClient.
+//
+// Requests are only retried when a repeat cannot duplicate a write: reads, PATCHes,
+// PostgREST upserts (resolution=merge-duplicates or ignore-duplicates) and OpenAI
+// moderation checks retry on transport errors, 429 and 5xx; plain inserts and model
+// calls, which are billed and may run tools, retry only when the upstream provably
+// did not process them (dial failures and 429).
+
+var errCircuitOpen = errors.New("upstream temporarily unavailable (circuit open)")
+
+type retryPolicy struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+}
+
+func upstreamPolicy(ctx context.Context) retryPolicy {
+	c := configFor(ctx)
+	return retryPolicy{MaxRetries: c.UpstreamMaxRetries, BaseDelay: c.UpstreamRetryBase, MaxDelay: c.UpstreamRetryMax}
+}
+
+// backoff returns the delay before retry n (0-based): full jitter over an exponential cap.
+func (p retryPolicy) backoff(n int) time.Duration {
+	d := p.BaseDelay << n
+	if d <= 0 || d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// retryAfter parses a Retry-After header (delta-seconds or HTTP date).
+func retryAfter(res *http.Response) (time.Duration, bool) {
+	if res == nil {
+		return 0, false
+	}
+	h := strings.TrimSpace(res.Header.Get("Retry-After"))
+	if h == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(h); err == nil {
+		return time.Duration(s) * time.Second, true
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		return time.Until(t), true
+	}
+	return 0, false
+}
+
+// idempotent reports whether sending req twice cannot create duplicate rows.
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	if upstreamOf(req) == "openai" {
+		return strings.HasSuffix(req.URL.Path, "/moderations")
+	}
+	prefer := req.Header.Get("Prefer")
+	return strings.Contains(prefer, "resolution=merge-duplicates") || strings.Contains(prefer, "resolution=ignore-duplicates")
+}
+
+func notSent(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
+
+func shouldRetry(req *http.Request, res *http.Response, err error) bool {
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return false
+		}
+		return notSent(err) || idempotent(req)
+	}
+	switch res.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return idempotent(req)
+	}
+	return false
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker trips after upstream.breaker_threshold consecutive failures, rejects
+// calls for upstream.breaker_cooldown, then lets a single probe through; its outcome
+// closes or re-opens the breaker. Both are read per call, so reloads apply at once.
+type circuitBreaker struct {
+	Name   string
+	Tenant string
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = map[string]*circuitBreaker{}
+)
+
+// breakerFor returns ctx's tenant's breaker for upstream. Tenants can have their own
+// Supabase project and OpenAI key, so one tenant's outage or rate limit must not fail
+// calls for the others.
+func breakerFor(ctx context.Context, upstream string) *circuitBreaker {
+	tenant := tenantIDFrom(ctx)
+	key := tenant + "/" + upstream
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b := breakers[key]
+	if b == nil {
+		b = &circuitBreaker{Name: upstream, Tenant: tenant}
+		breakers[key] = b
+	}
+	return b
+}
+
+func (b *circuitBreaker) Allow(ctx context.Context) bool {
+	cooldown := configFor(ctx).BreakerCooldown
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+func (b *circuitBreaker) Record(ctx context.Context, ok bool) {
+	threshold := configFor(ctx).BreakerThreshold
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if ok {
+		if b.state != breakerClosed {
+			logger.Info("circuit closed", "upstream", b.Name, "tenant_id", b.Tenant)
+		}
+		b.state, b.failures = breakerClosed, 0
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= threshold {
+		if b.state != breakerOpen {
+			logger.Warn("circuit opened", "upstream", b.Name, "tenant_id", b.Tenant, "failures", b.failures)
+		}
+		b.state, b.openedAt = breakerOpen, time.Now()
+	}
+}
+
+// Settle records the outcome of one logical call, after its retries. A call the caller
+// cancelled says nothing about the upstream; it only frees the half-open probe slot.
+func (b *circuitBreaker) Settle(ctx context.Context, res *http.Response, err error) {
+	if errors.Is(err, context.Canceled) {
+		b.mu.Lock()
+		b.probing = false
+		b.mu.Unlock()
+		return
+	}
+	b.Record(ctx, !upstreamFailure(res, err))
+}
+
+func (b *circuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return [...]string{"closed", "open", "half_open"}[b.state]
+}
+
+// upstreamFailure is what the breaker counts against an upstream.
+func upstreamFailure(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShouldRetry(t *testing.T) {
+	prev := getConfig()
+	t.Cleanup(func() { setConfig(prev) })
+	updateConfig(func(c *RuntimeConfig) {
+		c.SupabaseURL, c.OpenAIBaseURL = "https://sb.example", "https://api.openai.example/v1"
+	})
+	req := func(method, url, prefer string) *http.Request {
+		r := httptest.NewRequest(method, url, nil)
+		if prefer != "" {
+			r.Header.Set("Prefer", prefer)
+		}
+		return r
+	}
+	sent := errors.New("connection reset by peer")
+	cases := []struct {
+		name   string
+		req    *http.Request
+		status int
+		err    error
+		want   bool
+	}{
+		{"read 503", req("GET", "https://sb.example/rest/v1/messages", ""), 503, nil, true},
+		{"insert 503", req("POST", "https://sb.example/rest/v1/messages", ""), 503, nil, false},
+		{"upsert 503", req("POST", "https://sb.example/rest/v1/app_users", "resolution=merge-duplicates"), 503, nil, true},
+		{"insert 429", req("POST", "https://sb.example/rest/v1/messages", ""), 429, nil, true},
+		{"model call 500", req("POST", "https://api.openai.example/v1/responses", ""), 500, nil, false},
+		{"model call reset", req("POST", "https://api.openai.example/v1/responses", ""), 0, sent, false},
+		{"model call 429", req("POST", "https://api.openai.example/v1/responses", ""), 429, nil, true},
+		{"moderation 500", req("POST", "https://api.openai.example/v1/moderations", ""), 500, nil, true},
+	}
+	for _, tc := range cases {
+		var res *http.Response
+		if tc.err == nil {
+			res = &http.Response{StatusCode: tc.status}
+		}
+		if got := shouldRetry(tc.req, res, tc.err); got != tc.want {
+			t.Errorf("%s: shouldRetry = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestBreakerReadsReloadedConfig(t *testing.T) {
+	prev := getConfig()
+	t.Cleanup(func() { setConfig(prev) })
+	updateConfig(func(c *RuntimeConfig) { c.BreakerThreshold, c.BreakerCooldown = 5, time.Hour })
+	ctx := context.Background()
+	b := &circuitBreaker{Name: "test"}
+	b.Record(ctx, false)
+	if b.State() != "closed" {
+		t.Fatalf("opened after one failure with threshold 5")
+	}
+	updateConfig(func(c *RuntimeConfig) { c.BreakerThreshold, c.BreakerCooldown = 2, time.Millisecond })
+	b.Record(ctx, false)
+	if b.State() != "open" {
+		t.Fatalf("state = %s after the threshold was lowered to 2, want open", b.State())
+	}
+	time.Sleep(2 * time.Millisecond)
+	if !b.Allow(ctx) {
+		t.Error("probe rejected after the shortened cooldown")
+	}
+}
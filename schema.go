@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The extractor's JSON schema is composed per turn: the base fields every
+// conversation needs, plus the fields of the workflow (WORKFLOWS.md) the
+// conversation is in and any custom fields the tenant adds to it. A workflow's
+// required fields are its slots; they are kept in conversation metadata across
+// turns until all are filled.
+
+// extractionField is a workflow field. Fields are always nullable in the schema;
+// Required marks the slots the workflow needs before it can act.
+type extractionField struct {
+	Type        string   `json:"type"`
+	Enum        []string `json:"enum,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Required    bool     `json:"required,omitempty"`
+}
+
+type extractionWorkflow struct {
+	ID      string
+	Name    string
+	Intents []string
+	Fields  map[string]extractionField
+}
+
+var extractionWorkflows = []extractionWorkflow{
+	{ID: "WF-04", Name: "order status request", Intents: []string{"order_support", "shipping_delivery"}},
+	{ID: "WF-05", Name: "return or refund request", Intents: []string{"returns_refunds"}, Fields: map[string]extractionField{
+		"item":                 {Type: "string", Description: "The product the user wants to return or get a refund for.", Required: true},
+		"reason":               {Type: "string", Description: "Why the user is returning it, in their words.", Required: true},
+		"preferred_resolution": {Type: "string", Enum: []string{"return", "refund", "exchange"}, Description: "What the user wants: return, refund or exchange.", Required: true},
+	}},
+	{ID: "WF-06", Name: "handoff request", Intents: []string{"handoff_human"}},
+}
+
+func workflowByID(id string) *extractionWorkflow {
+	for i := range extractionWorkflows {
+		if extractionWorkflows[i].ID == id {
+			return &extractionWorkflows[i]
+		}
+	}
+	return nil
+}
+
+func workflowForIntent(intent string) *extractionWorkflow {
+	for i := range extractionWorkflows {
+		if containsString(extractionWorkflows[i].Intents, intent) {
+			return &extractionWorkflows[i]
+		}
+	}
+	return nil
+}
+
+// activeWorkflow is the workflow intent routes to or, for turns without a clear
+// intent, the one the conversation is already in.
+func activeWorkflow(intent string, convMeta map[string]any) *extractionWorkflow {
+	if wf := workflowForIntent(intent); wf != nil {
+		return wf
+	}
+	if intent == "" || intent == "other" {
+		return workflowByID(asString(mapOf(convMeta["workflow"])["id"]))
+	}
+	return nil
+}
+
+// workflowFields are wf's built-in fields with the tenant's extraction_fields for it
+// laid over them.
+func workflowFields(ctx context.Context, wf *extractionWorkflow) map[string]extractionField {
+	out := map[string]extractionField{}
+	if wf == nil {
+		return out
+	}
+	for k, f := range wf.Fields {
+		out[k] = f
+	}
+	t, _ := tenantFrom(ctx)
+	for k, f := range t.ExtractionFields[wf.ID] {
+		out[k] = f
+	}
+	return out
+}
+
+// missingSlots lists wf's required fields that slots does not hold yet.
+func missingSlots(ctx context.Context, wf *extractionWorkflow, slots map[string]any) []string {
+	fields := workflowFields(ctx, wf)
+	missing := []string{}
+	for _, k := range sortedKeys(fields) {
+		if fields[k].Required && slots[k] == nil {
+			missing = append(missing, k)
+		}
+	}
+	return missing
+}
+
+func nullable(t string) []any { return []any{t, "null"} }
+
+func extractionSchema(ctx context.Context, wf *extractionWorkflow) map[string]any {
+	props := map[string]any{
+		"name":     map[string]any{"type": nullable("string")},
+		"email":    map[string]any{"type": nullable("string")},
+		"phone":    map[string]any{"type": nullable("string")},
+		"order_id": map[string]any{"type": nullable("string")},
+		"address":  map[string]any{"type": nullable("string")},
+		"address_components": map[string]any{
+			"type":                 "object",
+			"additionalProperties": false,
+			"properties": map[string]any{
+				"line1":       map[string]any{"type": nullable("string")},
+				"line2":       map[string]any{"type": nullable("string")},
+				"city":        map[string]any{"type": nullable("string")},
+				"state":       map[string]any{"type": nullable("string")},
+				"postal_code": map[string]any{"type": nullable("string")},
+				"country":     map[string]any{"type": nullable("string")},
+			},
+			"required": []string{"line1", "line2", "city", "state", "postal_code", "country"},
+		},
+		"intent": map[string]any{
+			"type": "string",
+			"enum": []string{"product_or_content", "order_support", "returns_refunds", "shipping_delivery", "account_support", "handoff_human", "other"},
+		},
+		"confidence":         map[string]any{"type": "integer", "minimum": 0, "maximum": 100},
+		"needs_verification": map[string]any{"type": "boolean"},
+		"notes":              map[string]any{"type": nullable("string")},
+	}
+	required := []string{"name", "email", "phone", "order_id", "address", "address_components", "intent", "confidence", "needs_verification", "notes"}
+	fields := workflowFields(ctx, wf)
+	for _, k := range sortedKeys(fields) {
+		f := fields[k]
+		p := map[string]any{"type": nullable(f.Type)}
+		if f.Description != "" {
+			p["description"] = f.Description
+		}
+		if len(f.Enum) > 0 {
+			enum := []any{}
+			for _, e := range f.Enum {
+				enum = append(enum, e)
+			}
+			p["enum"] = append(enum, nil)
+		}
+		props[k] = p
+		required = append(required, k)
+	}
+	return map[string]any{"type": "object", "additionalProperties": false, "properties": props, "required": required}
+}
+
+var extractorRepairs = newCounterVec("chatbot_extractor_schema_repairs_total", "Extractor outputs that had to be repaired to match the schema, or were rejected.", "outcome")
+
+var (
+	jsonFence     = regexp.MustCompile("(?s)```(?:json)?\\s*(.*?)```")
+	trailingComma = regexp.MustCompile(`,\s*([}\]])`)
+)
+
+// parseModelJSON reads the JSON object in a model reply. Replies that are not a bare
+// object are repaired where the intent is clear (code fences, text around the object,
+// trailing commas); repaired reports that this was needed.
+func parseModelJSON(text string) (v map[string]any, repaired bool, err error) {
+	s := strings.TrimSpace(text)
+	if json.Unmarshal([]byte(s), &v) == nil && v != nil {
+		return v, false, nil
+	}
+	if m := jsonFence.FindStringSubmatch(s); m != nil {
+		s = m[1]
+	}
+	start, end := strings.Index(s, "{"), strings.LastIndex(s, "}")
+	if start < 0 || end < start {
+		return nil, false, fmt.Errorf("no JSON object in model output")
+	}
+	s = trailingComma.ReplaceAllString(s[start:end+1], "$1")
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return nil, false, fmt.Errorf("malformed JSON in model output: %w", err)
+	}
+	return v, true, nil
+}
+
+// conformToSchema checks v against schema (the subset of JSON Schema the extractor
+// uses: types, nullable types, enums, required, additionalProperties, integer bounds)
+// and returns it repaired. Unknown keys are dropped, numbers and booleans sent as
+// strings are converted, enum values are matched case-insensitively, and values
+// that are missing or cannot be used become null or, for non-nullable fields, the
+// value in defaults. Each repair is described in fixes; err is set when a value can
+// be neither used nor replaced.
+func conformToSchema(v any, schema map[string]any, defaults any) (out any, fixes []string, err error) {
+	if _, ok := v.(map[string]any); !ok {
+		return nil, nil, fmt.Errorf("$: not an object")
+	}
+	out, err = conform("$", v, schema, defaults, &fixes)
+	return out, fixes, err
+}
+
+func conform(path string, v any, s map[string]any, def any, fixes *[]string) (any, error) {
+	types := schemaTypes(s)
+	canNull := containsString(types, "null")
+	fallback := func(why string) (any, error) {
+		if canNull {
+			*fixes = append(*fixes, path+": "+why+", set to null")
+			return nil, nil
+		}
+		if def != nil {
+			*fixes = append(*fixes, fmt.Sprintf("%s: %s, set to %v", path, why, def))
+			return def, nil
+		}
+		return nil, fmt.Errorf("%s: %s", path, why)
+	}
+	if v == nil {
+		if canNull {
+			return nil, nil
+		}
+		return fallback("missing")
+	}
+	if enum := schemaEnum(s); len(enum) > 0 {
+		str, ok := v.(string)
+		if !ok {
+			return fallback(fmt.Sprintf("%v is not a string", v))
+		}
+		for _, e := range enum {
+			if strings.EqualFold(e, strings.TrimSpace(str)) {
+				if e != str {
+					*fixes = append(*fixes, fmt.Sprintf("%s: %q read as %q", path, str, e))
+				}
+				return e, nil
+			}
+		}
+		return fallback(fmt.Sprintf("%q is not one of %s", str, strings.Join(enum, ", ")))
+	}
+	switch types[0] {
+	case "object":
+		m, ok := v.(map[string]any)
+		if !ok {
+			return fallback("not an object")
+		}
+		props, defs := mapOf(s["properties"]), mapOf(def)
+		out := map[string]any{}
+		for _, k := range sortedKeys(m) {
+			if _, known := props[k]; !known {
+				*fixes = append(*fixes, path+"."+k+": unknown key dropped")
+			}
+		}
+		required, _ := s["required"].([]string)
+		for _, k := range sortedKeys(props) {
+			val, present := m[k]
+			if !present && !containsString(required, k) {
+				continue
+			}
+			if !present && containsString(schemaTypes(mapOf(props[k])), "null") {
+				*fixes = append(*fixes, path+"."+k+": missing, set to null")
+			}
+			nv, err := conform(path+"."+k, val, mapOf(props[k]), defs[k], fixes)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = nv
+		}
+		return out, nil
+	case "string":
+		switch t := v.(type) {
+		case string:
+			return t, nil
+		case float64, bool:
+			*fixes = append(*fixes, fmt.Sprintf("%s: %v converted to a string", path, t))
+			return fmt.Sprint(t), nil
+		}
+		return fallback("not a string")
+	case "integer", "number":
+		var n float64
+		switch t := v.(type) {
+		case float64:
+			n = t
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(t), "%"), 64)
+			if err != nil {
+				return fallback(fmt.Sprintf("%q is not a number", t))
+			}
+			*fixes = append(*fixes, fmt.Sprintf("%s: %q converted to a number", path, t))
+			n = f
+		default:
+			return fallback("not a number")
+		}
+		if types[0] == "integer" && n != math.Trunc(n) {
+			*fixes = append(*fixes, fmt.Sprintf("%s: %v rounded", path, n))
+			n = math.Round(n)
+		}
+		if lo, ok := s["minimum"]; ok && n < toFloat(lo) {
+			*fixes = append(*fixes, fmt.Sprintf("%s: %v raised to %v", path, n, lo))
+			n = toFloat(lo)
+		}
+		if hi, ok := s["maximum"]; ok && n > toFloat(hi) {
+			*fixes = append(*fixes, fmt.Sprintf("%s: %v lowered to %v", path, n, hi))
+			n = toFloat(hi)
+		}
+		if types[0] == "integer" {
+			return int(n), nil
+		}
+		return n, nil
+	case "boolean":
+		switch t := v.(type) {
+		case bool:
+			return t, nil
+		case string:
+			if b, err := strconv.ParseBool(strings.TrimSpace(t)); err == nil {
+				*fixes = append(*fixes, fmt.Sprintf("%s: %q converted to a boolean", path, t))
+				return b, nil
+			}
+		}
+		return fallback("not a boolean")
+	}
+	return v, nil
+}
+
+// schemaTypes returns a schema's types with "null", if allowed, last.
+func schemaTypes(s map[string]any) []string {
+	out, null := []string{}, false
+	switch t := s["type"].(type) {
+	case string:
+		out = append(out, t)
+	case []any:
+		for _, x := range t {
+			if asString(x) == "null" {
+				null = true
+			} else {
+				out = append(out, asString(x))
+			}
+		}
+	}
+	if null {
+		out = append(out, "null")
+	}
+	return out
+}
+
+func schemaEnum(s map[string]any) []string {
+	switch e := s["enum"].(type) {
+	case []string:
+		return e
+	case []any:
+		out := []string{}
+		for _, x := range e {
+			if x != nil {
+				out = append(out, asString(x))
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+var fieldName = regexp.MustCompile(`^[a-z][a-z0-9_]{0,39}$`)
+
+// validateExtractionFields checks a tenant's extraction_fields.
+func validateExtractionFields(tenant string, byWorkflow map[string]map[string]extractionField) []string {
+	p := []string{}
+	base := mapOf(extractionSchema(context.Background(), nil)["properties"])
+	for _, id := range sortedKeys(byWorkflow) {
+		if workflowByID(id) == nil {
+			p = append(p, fmt.Sprintf("tenants: %s extraction_fields: unknown workflow %q", tenant, id))
+			continue
+		}
+		for _, name := range sortedKeys(byWorkflow[id]) {
+			f := byWorkflow[id][name]
+			switch {
+			case !fieldName.MatchString(name):
+				p = append(p, fmt.Sprintf("tenants: %s extraction_fields.%s: %q must be snake_case", tenant, id, name))
+			case base[name] != nil:
+				p = append(p, fmt.Sprintf("tenants: %s extraction_fields.%s: %q is a built-in field", tenant, id, name))
+			case !containsString([]string{"string", "integer", "number", "boolean"}, f.Type):
+				p = append(p, fmt.Sprintf("tenants: %s extraction_fields.%s.%s: type must be string, integer, number or boolean", tenant, id, name))
+			case len(f.Enum) > 0 && f.Type != "string":
+				p = append(p, fmt.Sprintf("tenants: %s extraction_fields.%s.%s: enum needs type string", tenant, id, name))
+			}
+		}
+	}
+	return p
+}
+
+// updateWorkflow records the turn's workflow fields in the conversation's slots and
+// stores the workflow state on extracted for the reply and the chat model's note.
+// changed reports whether convMeta was updated.
+func updateWorkflow(ctx context.Context, extracted, convMeta map[string]any) (changed bool) {
+	wf := activeWorkflow(asString(extracted["intent"]), convMeta)
+	if wf == nil {
+		return false
+	}
+	state := mapOf(convMeta["workflow"])
+	slots := map[string]any{}
+	if asString(state["id"]) == wf.ID {
+		slots = mapOf(state["slots"])
+	}
+	for k := range workflowFields(ctx, wf) {
+		if v := extracted[k]; v != nil && asString(v) != "" {
+			changed = changed || slots[k] != v
+			slots[k] = v
+		}
+	}
+	changed = changed || asString(state["id"]) != wf.ID
+	convMeta["workflow"] = map[string]any{"id": wf.ID, "slots": slots}
+	extracted["workflow"] = map[string]any{"id": wf.ID, "name": wf.Name, "slots": slots, "missing": missingSlots(ctx, wf, slots)}
+	return changed
+}
+
+// workflowNote asks the chat model for the next missing slot, one at a time.
+func workflowNote(extracted map[string]any) string {
+	state := mapOf(extracted["workflow"])
+	missing, _ := state["missing"].([]string)
+	if len(missing) == 0 {
+		return ""
+	}
+	label := func(k string) string { return strings.ReplaceAll(k, "_", " ") }
+	return fmt.Sprintf("For this %s we still need: %s. Ask only for the %s in this reply.", asString(state["name"]), strings.Join(mapSlice(missing, label), ", "), label(missing[0]))
+}
+
+func mapSlice(in []string, f func(string) string) []string {
+	out := make([]string, len(in))
+	for i, s := range in {
+		out[i] = f(s)
+	}
+	return out
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestParseModelJSON(t *testing.T) {
+	cases := []struct {
+		text     string
+		repaired bool
+		ok       bool
+	}{
+		{`{"name": "Jane"}`, false, true},
+		{"```json\n{\"name\": \"Jane\"}\n```", true, true},
+		{`Here you go: {"name": "Jane",} Hope that helps.`, true, true},
+		{`no json here`, false, false},
+		{`{"name": }`, false, false},
+	}
+	for _, tc := range cases {
+		v, repaired, err := parseModelJSON(tc.text)
+		if (err == nil) != tc.ok || repaired != tc.repaired {
+			t.Errorf("parseModelJSON(%q) = repaired %v, err %v; want repaired %v, ok %v", tc.text, repaired, err, tc.repaired, tc.ok)
+		}
+		if tc.ok && v["name"] != "Jane" {
+			t.Errorf("parseModelJSON(%q) = %v", tc.text, v)
+		}
+	}
+}
+
+func TestConformToSchema(t *testing.T) {
+	schema := extractionSchema(context.Background(), workflowByID("WF-05"))
+	in := map[string]any{
+		"name": "Jane", "email": nil, "order_id": 12345.0, "intent": "Returns_Refunds",
+		"confidence": "87.6%", "needs_verification": "false", "surprise": true,
+		"address_components":   map[string]any{"city": "Leeds"},
+		"preferred_resolution": "REFUND", "reason": "too small",
+	}
+	out, fixes, err := conformToSchema(in, schema, emptyExtraction())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := out.(map[string]any)
+	want := map[string]any{
+		"name": "Jane", "email": nil, "order_id": "12345", "intent": "returns_refunds", "confidence": 88,
+		"needs_verification": false, "preferred_resolution": "refund", "reason": "too small", "item": nil, "notes": nil,
+	}
+	for k, v := range want {
+		if !reflect.DeepEqual(m[k], v) {
+			t.Errorf("%s = %#v, want %#v", k, m[k], v)
+		}
+	}
+	if _, ok := m["surprise"]; ok {
+		t.Error("unknown key kept")
+	}
+	if c := mapOf(m["address_components"]); c["city"] != "Leeds" || c["line1"] != nil {
+		t.Errorf("address_components = %v", c)
+	}
+	if len(fixes) == 0 {
+		t.Error("no fixes reported")
+	}
+
+	// A non-nullable field that cannot be used falls back to its default.
+	out, _, err = conformToSchema(map[string]any{"intent": "chitchat", "confidence": 120.0}, schema, emptyExtraction())
+	if m := mapOf(out); err != nil || m["intent"] != "other" || m["confidence"] != 100 {
+		t.Errorf("fallbacks: %v, %v", out, err)
+	}
+	if _, _, err := conformToSchema([]any{1}, schema, nil); err == nil {
+		t.Error("non-object accepted")
+	}
+	if _, _, err := conformToSchema(map[string]any{"confidence": "high"}, schema, nil); err == nil {
+		t.Error("unusable non-nullable value without a default accepted")
+	}
+}
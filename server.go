@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type serverConfig struct {
+	Addr              string        `json:"addr"`
+	ReadTimeout       time.Duration `json:"read_timeout"`
+	ReadHeaderTimeout time.Duration `json:"read_header_timeout"`
+	WriteTimeout      time.Duration `json:"write_timeout"`
+	IdleTimeout       time.Duration `json:"idle_timeout"`
+	MaxHeaderBytes    int           `json:"max_header_bytes"`
+	MaxBodyBytes      int64         `json:"max_body_bytes"`
+	ShutdownTimeout   time.Duration `json:"shutdown_timeout"`
+	DrainDelay        time.Duration `json:"drain_delay"`
+	TLSCertFile       string        `json:"tls_cert_file,omitempty"`
+	TLSKeyFile        string        `json:"tls_key_file,omitempty"`
+	MetricsAddr       string        `json:"metrics_addr,omitempty"`
+}
+
+var draining atomic.Bool
+
+// runServer serves h until SIGINT/SIGTERM. It then fails /health for DrainDelay so load
+// balancers stop routing to it, stops accepting connections, waits for in-flight
+// requests, and flushes background writes, the outbox and pending spans, all bounded
+// by ShutdownTimeout. A second signal skips the delay. With MetricsAddr set, /metrics
+// is also served there without authentication, for scrapers on a private network.
+func runServer(h http.Handler, sc serverConfig) error {
+	srv := &http.Server{
+		Addr:              sc.Addr,
+		Handler:           http.MaxBytesHandler(h, sc.MaxBodyBytes),
+		ReadTimeout:       sc.ReadTimeout,
+		ReadHeaderTimeout: sc.ReadHeaderTimeout,
+		WriteTimeout:      sc.WriteTimeout,
+		IdleTimeout:       sc.IdleTimeout,
+		MaxHeaderBytes:    sc.MaxHeaderBytes,
+	}
+	errCh := make(chan error, 2)
+	go func() {
+		tls := sc.TLSCertFile != "" && sc.TLSKeyFile != ""
+		logger.Info("listening", "addr", sc.Addr, "tls", tls)
+		if tls {
+			errCh <- srv.ListenAndServeTLS(sc.TLSCertFile, sc.TLSKeyFile)
+		} else {
+			errCh <- srv.ListenAndServe()
+		}
+	}()
+
+	var metricsSrv *http.Server
+	if sc.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", metricsHandler)
+		metricsSrv = &http.Server{Addr: sc.MetricsAddr, Handler: mux, ReadHeaderTimeout: sc.ReadHeaderTimeout, WriteTimeout: 30 * time.Second}
+		go func() {
+			logger.Info("serving metrics", "addr", sc.MetricsAddr)
+			if err := metricsSrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				errCh <- err
+			}
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	select {
+	case err := <-errCh:
+		return err
+	case s := <-sig:
+		logger.Info("shutting down", "signal", s.String(), "timeout", sc.ShutdownTimeout.String())
+	}
+
+	draining.Store(true)
+	if sc.DrainDelay > 0 {
+		logger.Info("draining before shutdown", "delay", sc.DrainDelay.String())
+		select {
+		case <-time.After(sc.DrainDelay):
+		case <-sig:
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sc.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warn("in-flight requests did not finish", "error", err.Error())
+	}
+	if metricsSrv != nil {
+		_ = metricsSrv.Shutdown(ctx)
+	}
+	if !waitCtx(ctx, waitBackground) {
+		logger.Warn("background writes still running at shutdown deadline")
+	}
+	if outboxQ != nil {
+		if err := outboxQ.Drain(ctx); err != nil {
+			logger.Warn("outbox not fully drained", "error", err.Error())
+		}
+	}
+	tracer.Flush(ctx)
+	logger.Info("shutdown complete")
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// watchConfigReload re-reads configuration on SIGHUP for the life of the process.
+func watchConfigReload(src configSources) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloadConfig(src); err != nil {
+				logger.Error("config reload rejected, keeping current settings", "error", err.Error())
+			}
+		}
+	}()
+}
+
+// waitCtx runs wait in the background and reports whether it returned before ctx ended.
+func waitCtx(ctx context.Context, wait func()) bool {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Tenant is one storefront served by this process. Empty fields fall back to the
+// process-wide configuration, so a single-shop deployment needs no tenants file and
+// runs as the implicit "default" tenant.
+//
+// Tenants are listed in the JSON file named by tenants.file (TENANTS_FILE). ${VAR}
+// references in the credential fields (supabase_url, supabase_service_role,
+// openai_api_key, api_keys and integration settings) are expanded from .env and the
+// environment so credentials can stay out of the file; prompts are left as written.
+type Tenant struct {
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Default bool   `json:"default,omitempty"`
+
+	// A request belongs to the tenant whose API key (X-Api-Key), path prefix or
+	// hostname matches, checked in that order.
+	Hosts      []string `json:"hosts,omitempty"`
+	APIKeys    []string `json:"api_keys,omitempty"`
+	PathPrefix string   `json:"path_prefix,omitempty"`
+
+	SupabaseURL         string              `json:"supabase_url,omitempty"`
+	SupabaseServiceRole string              `json:"supabase_service_role,omitempty"`
+	OpenAIAPIKey        string              `json:"openai_api_key,omitempty"`
+	PreferredModel      string              `json:"preferred_model,omitempty"`
+	ExtractorModel      string              `json:"extractor_model,omitempty"`
+	ModelFallbacks      map[string][]string `json:"model_fallbacks,omitempty"`
+	UIOrigins           []string            `json:"ui_origins,omitempty"`
+	// DefaultCountry (ISO 3166 alpha-2) replaces phone.default_country.
+	DefaultCountry string `json:"default_country,omitempty"`
+	// Budget and UserBudget replace budget.tenant and budget.user for this tenant.
+	Budget     *budgetLimits `json:"budget,omitempty"`
+	UserBudget *budgetLimits `json:"user_budget,omitempty"`
+	// ExtractionFields adds fields to a workflow's extraction schema, keyed by workflow
+	// id (WF-05) and field name.
+	ExtractionFields map[string]map[string]extractionField `json:"extraction_fields,omitempty"`
+
+	// Prompts replaces the built-in "system" and "extractor" prompts and adds "policy",
+	// store policies the bot may quote; {{shop_name}} is replaced with Name.
+	Prompts map[string]string `json:"prompts,omitempty"`
+	// Integrations maps an integration name (shopify, zoho_crm, zoho_desk, brevo,
+	// whatsapp) to its settings; an integration is enabled when present.
+	Integrations map[string]map[string]string `json:"integrations,omitempty"`
+}
+
+const defaultTenantID = "default"
+
+const tenantKeyHeader = "X-Api-Key"
+
+// tenantScoped are the tables that carry tenant_id; reads and updates against them are
+// filtered by it and inserts are stamped with it.
+var tenantScoped = map[string]bool{"app_users": true, "user_sessions": true, "identity_keys": true, "conversations": true, "messages": true, "events": true, "tool_calls": true, "llm_usage": true, "user_addresses": true, "privacy_requests": true}
+
+func loadTenants(path string, lookup func(string) string) ([]Tenant, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ts []Tenant
+	if err := json.Unmarshal(b, &ts); err != nil {
+		return nil, err
+	}
+	expand := func(v string) string {
+		return envRef.ReplaceAllStringFunc(v, func(ref string) string { return lookup(ref[2 : len(ref)-1]) })
+	}
+	for i := range ts {
+		t := &ts[i]
+		t.SupabaseURL, t.SupabaseServiceRole, t.OpenAIAPIKey = expand(t.SupabaseURL), expand(t.SupabaseServiceRole), expand(t.OpenAIAPIKey)
+		for j, k := range t.APIKeys {
+			t.APIKeys[j] = expand(k)
+		}
+		for _, settings := range t.Integrations {
+			for k, v := range settings {
+				settings[k] = expand(v)
+			}
+		}
+		ts[i].PathPrefix = strings.TrimRight(ts[i].PathPrefix, "/")
+		for j, h := range ts[i].Hosts {
+			ts[i].Hosts[j] = strings.ToLower(h)
+		}
+	}
+	return ts, nil
+}
+
+var envRef = regexp.MustCompile(`\$\{[A-Za-z_][A-Za-z0-9_]*\}`)
+
+// secretIntegrationKey reports whether an integration setting holds a credential.
+func secretIntegrationKey(k string) bool {
+	k = strings.ToLower(k)
+	return strings.Contains(k, "key") || strings.Contains(k, "token") || strings.Contains(k, "secret") || strings.Contains(k, "password")
+}
+
+// keepTenantSecrets gives the tenants in next that also exist in cur their current
+// credentials: like the global secrets, tenant credentials change only on restart.
+// Tenants added by a reload come in whole.
+func keepTenantSecrets(next, cur []Tenant) {
+	byID := map[string]Tenant{}
+	for _, t := range cur {
+		byID[t.ID] = t
+	}
+	for i := range next {
+		n, c := &next[i], byID[next[i].ID]
+		if c.ID == "" {
+			continue
+		}
+		changed := false
+		keep := func(dst *string, v string) {
+			changed = changed || *dst != v
+			*dst = v
+		}
+		keep(&n.SupabaseURL, c.SupabaseURL)
+		keep(&n.SupabaseServiceRole, c.SupabaseServiceRole)
+		keep(&n.OpenAIAPIKey, c.OpenAIAPIKey)
+		if strings.Join(n.APIKeys, "\n") != strings.Join(c.APIKeys, "\n") {
+			changed, n.APIKeys = true, c.APIKeys
+		}
+		for name, settings := range n.Integrations {
+			for k, v := range settings {
+				if secretIntegrationKey(k) {
+					keep(&v, c.Integrations[name][k])
+					settings[k] = v
+				}
+			}
+		}
+		if changed {
+			logger.Warn("tenant credential change needs a restart", "tenant_id", n.ID)
+		}
+	}
+}
+
+func validateTenants(ts []Tenant) []string {
+	p := []string{}
+	ids, hosts, keys, prefixes := map[string]bool{}, map[string]string{}, map[string]string{}, map[string]string{}
+	defaults := 0
+	claim := func(seen map[string]string, v, id, what string) {
+		if other, ok := seen[v]; ok {
+			p = append(p, fmt.Sprintf("tenants: %s %q is used by both %s and %s", what, v, other, id))
+		}
+		seen[v] = id
+	}
+	for _, t := range ts {
+		if t.ID == "" {
+			p = append(p, "tenants: every tenant needs an id")
+			continue
+		}
+		if ids[t.ID] {
+			p = append(p, fmt.Sprintf("tenants: duplicate id %q", t.ID))
+		}
+		ids[t.ID] = true
+		if t.Default {
+			defaults++
+		}
+		for _, h := range t.Hosts {
+			claim(hosts, h, t.ID, "host")
+		}
+		for _, k := range t.APIKeys {
+			claim(keys, k, t.ID, "api key")
+		}
+		if t.PathPrefix != "" {
+			if !strings.HasPrefix(t.PathPrefix, "/") || strings.HasPrefix(t.PathPrefix, "/v1") {
+				p = append(p, fmt.Sprintf("tenants: %s path_prefix %q must start with / and not shadow /v1", t.ID, t.PathPrefix))
+			}
+			claim(prefixes, t.PathPrefix, t.ID, "path_prefix")
+		}
+		if (t.SupabaseURL == "") != (t.SupabaseServiceRole == "") {
+			p = append(p, fmt.Sprintf("tenants: %s must set supabase_url and supabase_service_role together", t.ID))
+		}
+		for _, b := range []*budgetLimits{t.Budget, t.UserBudget} {
+			if b != nil && (b.DailyTokens < 0 || b.MonthlyTokens < 0 || b.DailyUSD < 0 || b.MonthlyUSD < 0) {
+				p = append(p, fmt.Sprintf("tenants: %s budget limits must not be negative", t.ID))
+			}
+		}
+		p = append(p, validateExtractionFields(t.ID, t.ExtractionFields)...)
+	}
+	if defaults > 1 {
+		p = append(p, "tenants: at most one tenant can be the default")
+	}
+	return p
+}
+
+// resolveTenant picks the tenant for r and the request path with any tenant prefix
+// removed. ok is false when tenants are configured and none matches; badKey is set when
+// an API key was sent but is not known.
+func resolveTenant(c RuntimeConfig, r *http.Request) (t Tenant, path string, ok, badKey bool) {
+	path = r.URL.Path
+	if len(c.Tenants) == 0 {
+		return Tenant{ID: defaultTenantID}, path, true, false
+	}
+	if key := strings.TrimSpace(r.Header.Get(tenantKeyHeader)); key != "" {
+		for _, t := range c.Tenants {
+			for _, k := range t.APIKeys {
+				if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+					return t, path, true, false
+				}
+			}
+		}
+		return Tenant{}, path, false, true
+	}
+	for _, t := range c.Tenants {
+		if p := t.PathPrefix; p != "" && (path == p || strings.HasPrefix(path, p+"/")) {
+			return t, "/" + strings.TrimLeft(strings.TrimPrefix(path, p), "/"), true, false
+		}
+	}
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, t := range c.Tenants {
+		if containsString(t.Hosts, host) {
+			return t, path, true, false
+		}
+	}
+	for _, t := range c.Tenants {
+		if t.Default {
+			return t, path, true, false
+		}
+	}
+	return Tenant{}, path, false, false
+}
+
+// tenantMiddleware attaches the request's tenant to the context. Process-wide
+// endpoints (health, metrics, admin) still work when no tenant matches.
+func tenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, path, ok, badKey := resolveTenant(getConfig(), r)
+		if !ok {
+			if badKey {
+				writeJSON(w, 401, map[string]any{"detail": "unknown API key"})
+				return
+			}
+			if p := r.URL.Path; p != "/health" && p != "/metrics" && !strings.HasPrefix(p, "/v1/admin/") {
+				writeJSON(w, 404, map[string]any{"detail": "unknown tenant"})
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if path != r.URL.Path {
+			r2 := r.Clone(r.Context())
+			r2.URL.Path, r2.URL.RawPath = path, ""
+			r = r2
+		}
+		if s := spanFrom(r.Context()); s != nil {
+			s.SetAttrs("tenant_id", t.ID)
+		}
+		next.ServeHTTP(w, r.WithContext(withTenant(r.Context(), t)))
+	})
+}
+
+func withTenant(ctx context.Context, t Tenant) context.Context {
+	return context.WithValue(ctx, tenantKey, t)
+}
+
+func tenantFrom(ctx context.Context) (Tenant, bool) {
+	t, ok := ctx.Value(tenantKey).(Tenant)
+	return t, ok
+}
+
+func tenantIDFrom(ctx context.Context) string {
+	if t, ok := tenantFrom(ctx); ok {
+		return t.ID
+	}
+	return defaultTenantID
+}
+
+// tenantByID finds a configured tenant, for work that outlives its request (outbox).
+func tenantByID(id string) Tenant {
+	for _, t := range getConfig().Tenants {
+		if t.ID == id {
+			return t
+		}
+	}
+	return Tenant{ID: id}
+}
+
+// configFor returns the configuration as seen by ctx's tenant.
+func configFor(ctx context.Context) RuntimeConfig {
+	t, ok := tenantFrom(ctx)
+	if !ok {
+		return getConfig()
+	}
+	return tenantConfig(getConfig(), t)
+}
+
+func tenantConfig(c RuntimeConfig, t Tenant) RuntimeConfig {
+	if t.SupabaseURL != "" {
+		c.SupabaseURL, c.SupabaseServiceRole = t.SupabaseURL, t.SupabaseServiceRole
+	}
+	c.OpenAIAPIKey = ternary(t.OpenAIAPIKey != "", t.OpenAIAPIKey, c.OpenAIAPIKey)
+	c.PreferredModel = ternary(t.PreferredModel != "", t.PreferredModel, c.PreferredModel)
+	c.ExtractorModel = ternary(t.ExtractorModel != "", t.ExtractorModel, c.ExtractorModel)
+	if len(t.ModelFallbacks) > 0 {
+		c.ModelFallbacks = t.ModelFallbacks
+	}
+	if len(t.UIOrigins) > 0 {
+		c.UIOrigins = t.UIOrigins
+	}
+	c.PhoneDefaultCountry = ternary(t.DefaultCountry != "", t.DefaultCountry, c.PhoneDefaultCountry)
+	if t.Budget != nil {
+		c.BudgetTenant = *t.Budget
+	}
+	if t.UserBudget != nil {
+		c.BudgetUser = *t.UserBudget
+	}
+	return c
+}
+
+// promptFor returns the tenant's prompt template name, or def.
+func promptFor(ctx context.Context, name, def string) string {
+	t, _ := tenantFrom(ctx)
+	p := def
+	if v := strings.TrimSpace(t.Prompts[name]); v != "" {
+		p = v + "\n"
+	}
+	return strings.ReplaceAll(p, "{{shop_name}}", ternary(t.Name != "", t.Name, "our store"))
+}
+
+// integrationFor returns the settings of an integration enabled for ctx's tenant.
+func integrationFor(ctx context.Context, name string) (map[string]string, bool) {
+	t, _ := tenantFrom(ctx)
+	s, ok := t.Integrations[name]
+	return s, ok
+}
+
+// scopeToTenant adds the tenant filter to reads/updates and stamps tenant_id on inserted
+// rows of tenant-scoped tables.
+func scopeToTenant(ctx context.Context, method, path string, params map[string]string, payload any) (map[string]string, any) {
+	table, _, _ := strings.Cut(strings.TrimLeft(path, "/"), "?")
+	if !tenantScoped[table] {
+		return params, payload
+	}
+	id := tenantIDFrom(ctx)
+	if method != http.MethodPost {
+		scoped := map[string]string{"tenant_id": "eq." + id}
+		for k, v := range params {
+			scoped[k] = v
+		}
+		return scoped, payload
+	}
+	switch p := payload.(type) {
+	case map[string]any:
+		return params, merge(map[string]any{"tenant_id": id}, p)
+	case []map[string]any:
+		rows := make([]map[string]any, len(p))
+		for i, row := range p {
+			rows[i] = merge(map[string]any{"tenant_id": id}, row)
+		}
+		return params, rows
+	}
+	return params, payload
+}
+
+// tenantInfo is what a tenant's own clients may see about it.
+func tenantInfo(ctx context.Context) map[string]any {
+	t, _ := tenantFrom(ctx)
+	return map[string]any{"id": tenantIDFrom(ctx), "name": t.Name, "integrations": sortedKeys(t.Integrations)}
+}
+
+func tenantSummaries(ts []Tenant) []map[string]any {
+	out := []map[string]any{}
+	for _, t := range ts {
+		out = append(out, map[string]any{
+			"id": t.ID, "name": t.Name, "default": t.Default, "hosts": t.Hosts, "path_prefix": t.PathPrefix,
+			"api_keys": len(t.APIKeys), "has_supabase": t.SupabaseURL != "", "has_openai_key": t.OpenAIAPIKey != "",
+			"preferred_model": t.PreferredModel, "prompts": sortedKeys(t.Prompts), "integrations": sortedKeys(t.Integrations),
+		})
+	}
+	return out
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadTenantsExpandsOnlyCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	_ = os.WriteFile(path, []byte(`[{"id": "acme", "openai_api_key": "${ACME_KEY}", "api_keys": ["${ACME_API}"],
+		"prompts": {"policy": "Shipping is $4.99, or free over $50. Ask for $name and ${ACME_KEY}."},
+		"integrations": {"brevo": {"api_key": "${ACME_BREVO}", "sender_email": "privacy@acme.example"}}}]`), 0o600)
+	env := map[string]string{"ACME_KEY": `sk-"quoted"\key`, "ACME_API": "k1", "ACME_BREVO": "xkeysib"}
+	ts, err := loadTenants(path, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := ts[0]
+	if a.OpenAIAPIKey != env["ACME_KEY"] || a.APIKeys[0] != "k1" || a.Integrations["brevo"]["api_key"] != "xkeysib" {
+		t.Errorf("credentials not expanded: %q %v %v", a.OpenAIAPIKey, a.APIKeys, a.Integrations)
+	}
+	if want := "Shipping is $4.99, or free over $50. Ask for $name and ${ACME_KEY}."; a.Prompts["policy"] != want {
+		t.Errorf("policy = %q, want it unchanged", a.Prompts["policy"])
+	}
+}
+
+func TestKeepTenantSecrets(t *testing.T) {
+	cur := []Tenant{{ID: "acme", OpenAIAPIKey: "old", Prompts: map[string]string{"policy": "old"}, Integrations: map[string]map[string]string{"brevo": {"api_key": "old", "sender_email": "old@acme.example"}}}}
+	next := []Tenant{
+		{ID: "acme", OpenAIAPIKey: "new", Prompts: map[string]string{"policy": "new"}, Integrations: map[string]map[string]string{"brevo": {"api_key": "new", "sender_email": "new@acme.example"}}},
+		{ID: "zeta", OpenAIAPIKey: "zeta"},
+	}
+	keepTenantSecrets(next, cur)
+	a := next[0]
+	if a.OpenAIAPIKey != "old" || a.Integrations["brevo"]["api_key"] != "old" {
+		t.Errorf("credentials reloaded: %q, %q", a.OpenAIAPIKey, a.Integrations["brevo"]["api_key"])
+	}
+	if a.Prompts["policy"] != "new" || a.Integrations["brevo"]["sender_email"] != "new@acme.example" {
+		t.Error("non-secret settings were not reloaded")
+	}
+	if next[1].OpenAIAPIKey != "zeta" {
+		t.Error("a new tenant lost its credentials")
+	}
+}
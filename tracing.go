@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lightweight OpenTelemetry-compatible tracing: W3C traceparent in and out, spans
+// exported as OTLP/HTTP JSON or as JSON lines on stdout.
+//
+//	OTEL_TRACES_EXPORTER=none|stdout|otlp (default none)
+//	OTEL_EXPORTER_OTLP_ENDPOINT=http://localhost:4318
+//	OTEL_SERVICE_NAME=go-chatbot
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+
+	mu     sync.Mutex
+	attrs  map[string]any
+	errMsg string
+	ended  bool
+}
+
+// tracer is replaced in main once configuration is loaded.
+var tracer = newTracer("none", "", "")
+
+type spanExporter struct {
+	mode     string
+	endpoint string
+	service  string
+	queue    chan *span
+	flushReq chan chan struct{}
+}
+
+func newTracer(mode, endpoint, service string) *spanExporter {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	if mode != "stdout" && mode != "otlp" {
+		return &spanExporter{mode: "none"}
+	}
+	e := &spanExporter{mode: mode, endpoint: strings.TrimRight(endpoint, "/"), service: service, queue: make(chan *span, 4096), flushReq: make(chan chan struct{})}
+	go e.loop()
+	return e
+}
+
+func (e *spanExporter) enabled() bool { return e.mode != "none" }
+
+func (e *spanExporter) enqueue(s *span) {
+	if !e.enabled() {
+		return
+	}
+	select {
+	case e.queue <- s:
+	default:
+		logger.Warn("trace queue full, dropping span", "span", s.name)
+	}
+}
+
+// Flush exports everything queued so far.
+func (e *spanExporter) Flush(ctx context.Context) {
+	if !e.enabled() {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case e.flushReq <- done:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func (e *spanExporter) loop() {
+	tick := time.NewTicker(2 * time.Second)
+	defer tick.Stop()
+	batch := []*span{}
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= 256 {
+				e.export(batch)
+				batch = nil
+			}
+		case <-tick.C:
+			if len(batch) > 0 {
+				e.export(batch)
+				batch = nil
+			}
+		case done := <-e.flushReq:
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+			}
+			if len(batch) > 0 {
+				e.export(batch)
+				batch = nil
+			}
+			close(done)
+		}
+	}
+}
+
+func (e *spanExporter) export(batch []*span) {
+	if e.mode == "stdout" {
+		enc := json.NewEncoder(os.Stdout)
+		for _, s := range batch {
+			_ = enc.Encode(map[string]any{"trace": s.otlp(), "service": e.service})
+		}
+		return
+	}
+	spans := make([]map[string]any, 0, len(batch))
+	for _, s := range batch {
+		spans = append(spans, s.otlp())
+	}
+	body := map[string]any{"resourceSpans": []any{map[string]any{
+		"resource":   map[string]any{"attributes": otlpAttrs(map[string]any{"service.name": e.service})},
+		"scopeSpans": []any{map[string]any{"scope": map[string]any{"name": "go-chatbot"}, "spans": spans}},
+	}}}
+	j, _ := json.Marshal(body)
+	// Deliberately not doReqWithClient: exporting must not create spans of its own.
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := client.Post(e.endpoint+"/v1/traces", "application/json", bytes.NewReader(j))
+	if err != nil {
+		logger.Warn("trace export failed", "error", err.Error(), "spans", len(batch))
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 400 {
+		logger.Warn("trace export rejected", "status", res.StatusCode, "spans", len(batch))
+	}
+}
+
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey).(*span)
+	return s
+}
+
+// startSpan opens a child of the span carried by ctx (or a new root). Callers must End it.
+func startSpan(ctx context.Context, name string, attrs ...any) (context.Context, *span) {
+	return startSpanKind(ctx, name, spanKindInternal, attrs...)
+}
+
+func startSpanKind(ctx context.Context, name string, kind int, attrs ...any) (context.Context, *span) {
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: map[string]any{}}
+	if parent := spanFrom(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+	}
+	_, _ = rand.Read(s.spanID[:])
+	if id := requestIDFrom(ctx); id != "" {
+		s.attrs["request_id"] = id
+	}
+	s.SetAttrs(attrs...)
+	return context.WithValue(ctx, spanKey, s), s
+}
+
+func (s *span) SetAttrs(kv ...any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i+1 < len(kv); i += 2 {
+		if k, ok := kv[i].(string); ok {
+			s.attrs[k] = kv[i+1]
+		}
+	}
+}
+
+func (s *span) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.errMsg = err.Error()
+	s.mu.Unlock()
+}
+
+func (s *span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	tracer.enqueue(s)
+}
+
+func (s *span) TraceID() string { return hex.EncodeToString(s.traceID[:]) }
+
+func (s *span) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", s.TraceID(), hex.EncodeToString(s.spanID[:]))
+}
+
+func (s *span) otlp() map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := map[string]any{
+		"traceId":           s.TraceID(),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttrs(s.attrs),
+		"status":            map[string]any{"code": 0},
+	}
+	if s.parentID != ([8]byte{}) {
+		out["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	if s.errMsg != "" {
+		out["status"] = map[string]any{"code": 2, "message": s.errMsg}
+	}
+	return out
+}
+
+func otlpAttrs(m map[string]any) []any {
+	out := []any{}
+	for _, k := range sortedKeys(m) {
+		var v map[string]any
+		switch t := m[k].(type) {
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(t)}
+		case int64:
+			v = map[string]any{"intValue": strconv.FormatInt(t, 10)}
+		case bool:
+			v = map[string]any{"boolValue": t}
+		case float64:
+			v = map[string]any{"doubleValue": t}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(t)}
+		}
+		out = append(out, map[string]any{"key": k, "value": v})
+	}
+	return out
+}
+
+// parseTraceparent reads a W3C traceparent header into a remote parent span.
+func parseTraceparent(h string) *span {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil
+	}
+	s := &span{}
+	if _, err := hex.Decode(s.traceID[:], []byte(parts[1])); err != nil {
+		return nil
+	}
+	if _, err := hex.Decode(s.spanID[:], []byte(parts[2])); err != nil {
+		return nil
+	}
+	if s.traceID == ([16]byte{}) || s.spanID == ([8]byte{}) {
+		return nil
+	}
+	return s
+}
+
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if remote := parseTraceparent(r.Header.Get("traceparent")); remote != nil {
+			ctx = context.WithValue(ctx, spanKey, remote)
+		}
+		ctx, s := startSpanKind(ctx, r.Method+" "+r.URL.Path, spanKindServer, "http.method", r.Method, "http.target", r.URL.Path)
+		defer s.End()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		s.SetAttrs("http.status_code", ternary(rec.status == 0, http.StatusOK, rec.status))
+		if rec.status >= 500 {
+			s.RecordError(fmt.Errorf("http %d", rec.status))
+		}
+	})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tokenUsage is what one paid model call consumed. Cost comes from the capability
+// table's prices; Priced is false when the model has no price entry.
+type tokenUsage struct {
+	Model        string  `json:"model"`
+	InputTokens  int     `json:"input_tokens"`
+	CachedTokens int     `json:"cached_input_tokens"`
+	OutputTokens int     `json:"output_tokens"`
+	CostUSD      float64 `json:"cost_usd"`
+	Priced       bool    `json:"priced"`
+}
+
+var (
+	llmTokens  = newCounterVec("chatbot_llm_tokens_total", "Tokens consumed by model calls.", "model", "kind", "type")
+	llmCostUSD = newCounterVec("chatbot_llm_cost_usd_total", "Estimated USD cost of model calls.", "model", "kind")
+)
+
+// usageOf reads the usage block of a Responses API reply.
+func usageOf(model string, resp map[string]any) tokenUsage {
+	u, _ := resp["usage"].(map[string]any)
+	details, _ := u["input_tokens_details"].(map[string]any)
+	out := tokenUsage{Model: model, InputTokens: toInt(u["input_tokens"]), CachedTokens: toInt(details["cached_tokens"]), OutputTokens: toInt(u["output_tokens"])}
+	if c, ok := capabilityOf(model); ok {
+		uncached := max(out.InputTokens-out.CachedTokens, 0)
+		cost := (float64(uncached)*c.Price.Input + float64(out.CachedTokens)*c.Price.CachedInput + float64(out.OutputTokens)*c.Price.Output) / 1e6
+		out.CostUSD, out.Priced = roundUSD(cost), true
+	}
+	return out
+}
+
+func roundUSD(v float64) float64 { return math.Round(v*1e8) / 1e8 }
+
+// recordUsage stores one llm_usage row (through the outbox) and updates the metrics.
+// kind is "chat", "extractor" or "guardrail" (a regenerated reply).
+func recordUsage(ctx context.Context, client *http.Client, userID, conversationID, anon, kind string, u tokenUsage) error {
+	if u.Model == "" {
+		return nil
+	}
+	llmTokens.Add(float64(u.InputTokens-u.CachedTokens), u.Model, kind, "input")
+	llmTokens.Add(float64(u.CachedTokens), u.Model, kind, "cached_input")
+	llmTokens.Add(float64(u.OutputTokens), u.Model, kind, "output")
+	llmCostUSD.Add(u.CostUSD, u.Model, kind)
+	return writeAudit(ctx, client, "llm_usage", map[string]any{
+		"user_id": userID, "conversation_id": conversationID, "anon_id": anon, "kind": kind, "model": u.Model,
+		"input_tokens": u.InputTokens, "cached_input_tokens": u.CachedTokens, "output_tokens": u.OutputTokens,
+		"cost_usd": u.CostUSD, "priced": u.Priced, "request_id": requestIDFrom(ctx), "created_at": isoNow(),
+	})
+}
+
+type usageTotals struct {
+	Calls        int     `json:"calls"`
+	InputTokens  int     `json:"input_tokens"`
+	CachedTokens int     `json:"cached_input_tokens"`
+	OutputTokens int     `json:"output_tokens"`
+	CostUSD      float64 `json:"cost_usd"`
+}
+
+func (t *usageTotals) add(row map[string]any) {
+	t.Calls++
+	t.InputTokens += toInt(row["input_tokens"])
+	t.CachedTokens += toInt(row["cached_input_tokens"])
+	t.OutputTokens += toInt(row["output_tokens"])
+	t.CostUSD = roundUSD(t.CostUSD + toFloat(row["cost_usd"]))
+}
+
+// loadUsage reads the tenant's llm_usage rows in [from, to), paging through PostgREST's
+// row limit. filters are extra eq. filters (user_id, conversation_id).
+func loadUsage(ctx context.Context, client *http.Client, from, to time.Time, filters map[string]string) ([]map[string]any, error) {
+	const page = 1000
+	out := []map[string]any{}
+	for offset := 0; ; offset += page {
+		params := map[string]string{
+			"select": "user_id,conversation_id,anon_id,kind,model,input_tokens,cached_input_tokens,output_tokens,cost_usd,created_at",
+			"and":    "(created_at.gte." + isoTime(from) + ",created_at.lt." + isoTime(to) + ")",
+			"order":  "created_at.asc", "limit": strconv.Itoa(page), "offset": strconv.Itoa(offset),
+		}
+		for k, v := range filters {
+			params[k] = "eq." + v
+		}
+		res, err := sbGet(ctx, client, "llm_usage", params)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode >= 400 {
+			return nil, sbWriteErr("llm_usage", res, nil)
+		}
+		rows := toSliceMap(res)
+		out = append(out, rows...)
+		if len(rows) < page {
+			return out, nil
+		}
+	}
+}
+
+// usageRange parses from/to (YYYY-MM-DD, inclusive, or RFC3339) defaulting to the last
+// 30 days.
+func usageRange(q map[string][]string) (time.Time, time.Time, error) {
+	parse := func(v string, endOfDay bool) (time.Time, error) {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t, nil
+		}
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return t, errors.New("from/to must be YYYY-MM-DD or RFC3339")
+		}
+		return ternary(endOfDay, t.AddDate(0, 0, 1), t), nil
+	}
+	now := time.Now().UTC()
+	from, to := now.AddDate(0, 0, -30), now
+	var err error
+	if v := first(q["from"]); v != "" {
+		if from, err = parse(v, false); err != nil {
+			return from, to, err
+		}
+	}
+	if v := first(q["to"]); v != "" {
+		if to, err = parse(v, true); err != nil {
+			return from, to, err
+		}
+	}
+	if !from.Before(to) {
+		return from, to, errors.New("from must be before to")
+	}
+	return from, to, nil
+}
+
+// usageReportHandler serves GET /v1/admin/usage?from=&to=&group_by=day|user|conversation|model
+// with optional user_id / conversation_id filters, for the request's tenant.
+func usageReportHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	from, to, err := usageRange(q)
+	if err != nil {
+		writeJSON(w, 400, map[string]any{"detail": err.Error()})
+		return
+	}
+	groupBy := ternary(q.Get("group_by") != "", q.Get("group_by"), "day")
+	col := map[string]string{"day": "created_at", "user": "user_id", "conversation": "conversation_id", "model": "model", "kind": "kind"}[groupBy]
+	if col == "" {
+		writeJSON(w, 400, map[string]any{"detail": "group_by must be day, user, conversation, model or kind"})
+		return
+	}
+	filters := map[string]string{}
+	for _, f := range []string{"user_id", "conversation_id"} {
+		if v := strings.TrimSpace(q.Get(f)); v != "" {
+			filters[f] = v
+		}
+	}
+	rows, err := loadUsage(r.Context(), &http.Client{Timeout: 60 * time.Second}, from, to, filters)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	total := usageTotals{}
+	groups := map[string]*usageTotals{}
+	for _, row := range rows {
+		key := asString(row[col])
+		if groupBy == "day" && len(key) >= 10 {
+			key = key[:10]
+		}
+		if groups[key] == nil {
+			groups[key] = &usageTotals{}
+		}
+		groups[key].add(row)
+		total.add(row)
+	}
+	keys := sortedKeys(groups)
+	if groupBy != "day" {
+		sort.SliceStable(keys, func(i, j int) bool { return groups[keys[i]].CostUSD > groups[keys[j]].CostUSD })
+	}
+	out := []map[string]any{}
+	for _, k := range keys {
+		out = append(out, map[string]any{groupBy: k, "usage": groups[k]})
+	}
+	writeJSON(w, 200, map[string]any{"tenant_id": tenantIDFrom(r.Context()), "from": isoTime(from), "to": isoTime(to), "group_by": groupBy, "filters": filters, "total": total, "groups": out})
+}
+
+func first(vs []string) string {
+	if len(vs) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(vs[0])
+}